@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/snaigle/dproxy/util"
+	"net"
+	"time"
+)
+
+var errNotAllowed = errors.New("destination not allowed")
+
+// privateNets are the ranges of the networks around the exit node: its
+// LAN, the carrier network, loopback and link local addresses.
+var privateNets, _ = util.ParseDestList([]string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+})
+
+// Policy decides which destinations proxied connections may reach, so the
+// server and its users can't get into the network of the exit node.
+type Policy struct {
+	allow, deny           util.DestList
+	allowPorts, denyPorts []util.PortRange
+	allowPrivate          bool
+}
+
+func newPolicy(c *Config) (*Policy, error) {
+	p := &Policy{allowPrivate: c.AllowPrivate}
+	var err error
+	if p.allow, err = util.ParseDestList(c.AllowDest); err != nil {
+		return nil, err
+	}
+	if p.deny, err = util.ParseDestList(c.DenyDest); err != nil {
+		return nil, err
+	}
+	if p.allowPorts, err = util.ParsePortRanges(c.AllowPorts); err != nil {
+		return nil, err
+	}
+	if p.denyPorts, err = util.ParsePortRanges(c.DenyPorts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Resolve checks the host:port addr and returns the addresses to connect
+// to instead, in the order to try them. Host names are resolved here and
+// every address is checked, so a name can't be changed to point elsewhere
+// between the check and the dial. The error is errNotAllowed if the policy
+// rejects addr.
+func (p *Policy) Resolve(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if util.MatchPort(p.denyPorts, addr) || len(p.allowPorts) > 0 && !util.MatchPort(p.allowPorts, addr) {
+		return nil, errNotAllowed
+	}
+
+	var ips []net.IP
+	hostAllowed := false
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if p.deny.MatchHost(host) {
+			return nil, errNotAllowed
+		}
+		hostAllowed = p.allow.MatchHost(host)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.DialTimeout))
+		defer cancel()
+		if ips, err = resolver.LookupIP(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	ips = orderIPs(ips, opts.IPPreference, opts.HappyEyeballs)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no address of the preferred family", Name: host}
+	}
+
+	var allowed []string
+	for _, ip := range ips {
+		if p.allowsIP(ip, hostAllowed) {
+			allowed = append(allowed, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errNotAllowed
+	}
+	return allowed, nil
+}
+
+// allowsIP checks an address; hostAllowed tells whether it belongs to a
+// host name of the allow list.
+func (p *Policy) allowsIP(ip net.IP, hostAllowed bool) bool {
+	if p.deny.MatchIP(ip) {
+		return false
+	}
+	if p.allow.MatchIP(ip) {
+		return true
+	}
+	if !p.allowPrivate && privateNets.MatchIP(ip) {
+		return false
+	}
+	return hostAllowed || p.allow.Empty()
+}
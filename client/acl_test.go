@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// staticResolver resolves the host names it was given.
+type staticResolver map[string][]string
+
+func (r staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = net.ParseIP(a)
+	}
+	return ips, nil
+}
+
+func TestPolicy(t *testing.T) {
+	opts = defaultConfig()
+	resolver = staticResolver{
+		"example.com":        {"93.184.216.34", "2606:2800:220:1::1"},
+		"router.lan":         {"192.168.1.1"},
+		"rebind.example.com": {"93.184.216.34", "10.0.0.1"},
+		"intranet.corp":      {"10.1.2.3"},
+		"db.corp":            {"10.1.2.4"},
+		"tracker.ads.net":    {"203.0.113.7"},
+	}
+	tests := []struct {
+		name   string
+		config Config
+		addr   string
+		want   []string // nil if not allowed
+	}{
+		{"public ip", Config{}, "93.184.216.34:443", []string{"93.184.216.34:443"}},
+		{"public ipv6", Config{}, "[2606:2800:220:1::1]:443", []string{"[2606:2800:220:1::1]:443"}},
+		{"host name", Config{}, "example.com:80", []string{"93.184.216.34:80", "[2606:2800:220:1::1]:80"}},
+		{"loopback", Config{}, "127.0.0.1:22", nil},
+		{"ipv4 mapped loopback", Config{}, "[::ffff:127.0.0.1]:22", nil},
+		{"ipv6 loopback", Config{}, "[::1]:22", nil},
+		{"unspecified", Config{}, "0.0.0.0:80", nil},
+		{"lan", Config{}, "192.168.1.1:80", nil},
+		{"carrier nat", Config{}, "100.64.0.1:80", nil},
+		{"link local", Config{}, "169.254.169.254:80", nil},
+		{"ipv6 unique local", Config{}, "[fd00::1]:80", nil},
+		{"ipv6 link local", Config{}, "[fe80::1]:80", nil},
+		{"name of a lan address", Config{}, "router.lan:80", nil},
+		{"private addresses of a name are left out", Config{}, "rebind.example.com:80", []string{"93.184.216.34:80"}},
+		{"allow private", Config{AllowPrivate: true}, "192.168.1.1:80", []string{"192.168.1.1:80"}},
+		{"allowed cidr covers private", Config{AllowDest: []string{"10.1.0.0/16"}}, "10.1.2.3:80", []string{"10.1.2.3:80"}},
+		{"allowed host keeps private out", Config{AllowDest: []string{"*.corp"}}, "intranet.corp:80", nil},
+		{"allowed host with allow private", Config{AllowDest: []string{"*.corp"}, AllowPrivate: true}, "intranet.corp:80", []string{"10.1.2.3:80"}},
+		{"allow list rejects the rest", Config{AllowDest: []string{"*.corp"}}, "example.com:80", nil},
+		{"allow list of ips", Config{AllowDest: []string{"93.184.216.34"}}, "example.com:80", []string{"93.184.216.34:80"}},
+		{"allow list of ipv6", Config{AllowDest: []string{"2606:2800::/32"}}, "example.com:80", []string{"[2606:2800:220:1::1]:80"}},
+		{"denied host", Config{DenyDest: []string{"*.ads.net"}}, "tracker.ads.net:80", nil},
+		{"denied host ignores case", Config{DenyDest: []string{"*.ads.net"}}, "Tracker.ADS.net.:80", nil},
+		{"denied ip of a name", Config{DenyDest: []string{"203.0.113.0/24"}}, "tracker.ads.net:80", nil},
+		{"deny wins over allow", Config{AllowDest: []string{"10.0.0.0/8"}, DenyDest: []string{"10.1.2.4"}}, "db.corp:5432", nil},
+		{"deny wins over allow private", Config{AllowPrivate: true, DenyDest: []string{"192.168.0.0/16"}}, "192.168.1.1:80", nil},
+		{"denied ipv6", Config{DenyDest: []string{"2606:2800::/32"}}, "example.com:80", []string{"93.184.216.34:80"}},
+		{"allowed port", Config{AllowPorts: []string{"80", "443"}}, "93.184.216.34:443", []string{"93.184.216.34:443"}},
+		{"port not allowed", Config{AllowPorts: []string{"80", "443"}}, "93.184.216.34:22", nil},
+		{"denied port range", Config{DenyPorts: []string{"6000-6100"}}, "93.184.216.34:6010", nil},
+		{"deny port wins over allow", Config{AllowPorts: []string{"1-65535"}, DenyPorts: []string{"25"}}, "93.184.216.34:25", nil},
+		{"only ipv4", Config{IPPreference: onlyIPv4}, "example.com:80", []string{"93.184.216.34:80"}},
+	}
+	for _, tt := range tests {
+		c := tt.config
+		opts.IPPreference = c.IPPreference
+		p, err := newPolicy(&c)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := p.Resolve(tt.addr)
+		if tt.want == nil {
+			if err != errNotAllowed {
+				t.Errorf("%s: Resolve(%s) = %v, %v, want %v", tt.name, tt.addr, got, err, errNotAllowed)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Resolve(%s) = %v, %v, want %v", tt.name, tt.addr, got, err, tt.want)
+		}
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	opts = defaultConfig()
+	resolver = staticResolver{}
+	p, _ := newPolicy(&Config{})
+	for _, addr := range []string{"example.com", "missing.example.com:80"} {
+		if _, err := p.Resolve(addr); err == nil || err == errNotAllowed {
+			t.Errorf("Resolve(%s) got %v, want a lookup error", addr, err)
+		}
+	}
+	for _, c := range []Config{
+		{AllowDest: []string{"10.0.0.0/33"}},
+		{DenyDest: []string{"[a-"}},
+		{AllowPorts: []string{"0"}},
+		{DenyPorts: []string{"90-80"}},
+	} {
+		if _, err := newPolicy(&c); err == nil {
+			t.Errorf("newPolicy(%+v) accepted a bad config", c)
+		}
+	}
+}
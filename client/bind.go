@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"github.com/snaigle/dproxy/msg"
+	"github.com/snaigle/dproxy/util"
+	"log"
+	"net"
+	"time"
+)
+
+const bindAcceptTimeout = 2 * time.Minute
+
+// bind serves a SOCKS5 BIND: it listens on a port of this network, reports
+// the listening address, waits for the inbound connection from the expected
+// peer, reports its address and relays it over remoteConn.
+func bind(remoteConn net.Conn, startBind *msg.StartBind) {
+	// only accept the peer named in the request, unless it is a wildcard
+	expected, err := expectedPeers(startBind.ClientAddr)
+	if err != nil {
+		log.Println("Failed to resolve bind peer:", err)
+		msg.WriteMsg(remoteConn, &msg.BindResult{Error: err.Error()})
+		return
+	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Println("Failed to listen for bind:", err)
+		msg.WriteMsg(remoteConn, &msg.BindResult{Error: err.Error()})
+		return
+	}
+	defer ln.Close()
+
+	// report the address we reach the server from, a wildcard is useless
+	// to the peer
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	host, _, _ := net.SplitHostPort(remoteConn.LocalAddr().String())
+	if err = msg.WriteMsg(remoteConn, &msg.BindResult{Addr: net.JoinHostPort(host, port)}); err != nil {
+		return
+	}
+	log.Println("bind listening on", ln.Addr())
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(bindAcceptTimeout))
+	var localConn net.Conn
+	for {
+		if localConn, err = ln.Accept(); err != nil {
+			log.Println("Failed to accept bind connection:", err)
+			msg.WriteMsg(remoteConn, &msg.BindResult{Error: err.Error()})
+			return
+		}
+		peer := localConn.RemoteAddr().(*net.TCPAddr)
+		if expected == nil || containsIP(expected, peer.IP) {
+			break
+		}
+		log.Println("Rejecting bind connection from unexpected peer", peer)
+		localConn.Close()
+	}
+	defer localConn.Close()
+	if err = msg.WriteMsg(remoteConn, &msg.BindResult{Addr: localConn.RemoteAddr().String()}); err != nil {
+		return
+	}
+
+	go util.PipeThenClose(remoteConn, localConn)
+	util.PipeThenClose(localConn, remoteConn)
+}
+
+// expectedPeers returns the addresses the inbound connection of a BIND may
+// come from, a domain name is resolved. It returns nil for a wildcard.
+func expectedPeers(addr string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.DialTimeout))
+	defer cancel()
+	ips, err := resolver.LookupIP(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host}
+	}
+	return ips, err
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
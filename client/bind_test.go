@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpectedPeers(t *testing.T) {
+	opts = defaultConfig()
+	resolver = staticResolver{
+		"peer.example.com":  {"93.184.216.34", "2606:2800:220:1::1"},
+		"empty.example.com": {},
+	}
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{"0.0.0.0:0", "[]", false},
+		{"[::]:0", "[]", false},
+		{":0", "[]", false},
+		{"93.184.216.34:4000", "[93.184.216.34]", false},
+		{"[2606:2800:220:1::1]:4000", "[2606:2800:220:1::1]", false},
+		{"peer.example.com:4000", "[93.184.216.34 2606:2800:220:1::1]", false},
+		{"unknown.example.com:4000", "", true},
+		{"empty.example.com:4000", "", true},
+	}
+	for _, tt := range tests {
+		ips, err := expectedPeers(tt.addr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expectedPeers(%q) = %v, want an error", tt.addr, ips)
+			}
+			continue
+		}
+		if got := fmt.Sprint(ips); err != nil || got != tt.want {
+			t.Errorf("expectedPeers(%q) = %s, %v, want %s", tt.addr, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/snaigle/dproxy/util"
+	"net"
+	"os"
+	"time"
+)
+
+// Config holds the client settings. They are read from, in increasing
+// order of precedence, the defaults below, the file given by -config,
+// DPROXY_* environment variables and command line flags.
+type Config struct {
+	TunnelAddr   string  `json:"tunnelAddr" env:"DPROXY_TUNNEL_ADDR"`
+	Token        string  `json:"token" env:"DPROXY_TOKEN" secret:"true"`
+	CityCode     string  `json:"cityCode" env:"DPROXY_CITY_CODE"`
+	GpsLat       float64 `json:"gpsLat" env:"DPROXY_GPS_LAT"`
+	GpsLng       float64 `json:"gpsLng" env:"DPROXY_GPS_LNG"`
+	DeviceIdFile string  `json:"deviceIdFile" env:"DPROXY_DEVICE_ID_FILE"`
+
+	// share of traffic for the weighted-random balancing of the server
+	Weight int `json:"weight" env:"DPROXY_WEIGHT"`
+
+	// traffic this node relays per day and per month, e.g. "2GB", the
+	// server stops sending connections beyond it; 0 is unlimited
+	DailyQuota   util.ByteSize `json:"dailyQuota" env:"DPROXY_DAILY_QUOTA"`
+	MonthlyQuota util.ByteSize `json:"monthlyQuota" env:"DPROXY_MONTHLY_QUOTA"`
+
+	// concurrent proxied connections the server sends to this node, 0 is
+	// unlimited
+	MaxStreams int `json:"maxStreams" env:"DPROXY_MAX_STREAMS"`
+
+	// number of multiplexed sessions to keep open, 0 opens a new
+	// connection for every proxied connection instead
+	MuxSessions int `json:"muxSessions" env:"DPROXY_MUX_SESSIONS"`
+
+	// destinations proxied connections may reach: CIDRs, IPs and host name
+	// globs like "*.example.com", and ports or ranges like "8000-8999".
+	// Denied entries win, non-empty allow lists reject everything else.
+	// Private, loopback and link local addresses are denied unless
+	// allowPrivate is set or an allowed CIDR covers them.
+	AllowDest    util.StringList `json:"allowDest" env:"DPROXY_ALLOW_DEST"`
+	DenyDest     util.StringList `json:"denyDest" env:"DPROXY_DENY_DEST"`
+	AllowPorts   util.StringList `json:"allowPorts" env:"DPROXY_ALLOW_PORTS"`
+	DenyPorts    util.StringList `json:"denyPorts" env:"DPROXY_DENY_PORTS"`
+	AllowPrivate bool            `json:"allowPrivate" env:"DPROXY_ALLOW_PRIVATE"`
+
+	// how the targets of proxied connections are resolved: "system" for
+	// the resolver of the OS, a DNS server like "8.8.8.8" or
+	// "tcp://1.1.1.1:53", or a DNS-over-HTTPS url like
+	// "https://dns.google/dns-query"
+	Resolver string `json:"resolver" env:"DPROXY_RESOLVER"`
+
+	// which addresses of a target are tried first, "ipv4" or "ipv6", or
+	// at all, "ipv4-only" or "ipv6-only"; empty keeps the resolver order.
+	// With happyEyeballs the attempts race, RFC 8305, instead of
+	// following each other.
+	IPPreference  string `json:"ipPreference" env:"DPROXY_IP_PREFERENCE"`
+	HappyEyeballs bool   `json:"happyEyeballs" env:"DPROXY_HAPPY_EYEBALLS"`
+
+	// timeout for connecting to the targets of proxied connections
+	DialTimeout util.Duration `json:"dialTimeout" env:"DPROXY_DIAL_TIMEOUT"`
+
+	// timeout for connecting to the server and authenticating, a server
+	// that doesn't answer in time is retried like a lost connection
+	ConnectTimeout util.Duration `json:"connectTimeout" env:"DPROXY_CONNECT_TIMEOUT"`
+
+	// heartbeats and reconnects of the control connection
+	PingInterval      util.Duration `json:"pingInterval" env:"DPROXY_PING_INTERVAL"`
+	MaxPongLatency    util.Duration `json:"maxPongLatency" env:"DPROXY_MAX_PONG_LATENCY"`
+	MinReconnectDelay util.Duration `json:"minReconnectDelay" env:"DPROXY_MIN_RECONNECT_DELAY"`
+	MaxReconnectDelay util.Duration `json:"maxReconnectDelay" env:"DPROXY_MAX_RECONNECT_DELAY"`
+
+	// tls of the tunnel connections
+	TLS           bool   `json:"tls" env:"DPROXY_TLS"`
+	TLSCA         string `json:"tlsCA" env:"DPROXY_TLS_CA"`
+	TLSCert       string `json:"tlsCert" env:"DPROXY_TLS_CERT"`
+	TLSKey        string `json:"tlsKey" env:"DPROXY_TLS_KEY"`
+	TLSServerName string `json:"tlsServerName" env:"DPROXY_TLS_SERVER_NAME"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		TunnelAddr:        "127.0.0.1:1091",
+		DeviceIdFile:      ".dproxy-device-id",
+		Weight:            1,
+		Resolver:          "system",
+		DialTimeout:       util.Duration(10 * time.Second),
+		ConnectTimeout:    util.Duration(15 * time.Second),
+		PingInterval:      util.Duration(5 * time.Second),
+		MaxPongLatency:    util.Duration(15 * time.Second),
+		MinReconnectDelay: util.Duration(1 * time.Second),
+		MaxReconnectDelay: util.Duration(60 * time.Second),
+	}
+}
+
+// commandFlags are the command line flags that aren't part of the config.
+type commandFlags struct {
+	configFile  string
+	printConfig bool
+}
+
+func (c *Config) flagSet(cmd *commandFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&cmd.configFile, "config", "", "config file (.json, .yaml or .toml)")
+	fs.BoolVar(&cmd.printConfig, "print-config", false, "print the effective config and exit")
+
+	fs.StringVar(&c.TunnelAddr, "tunnel-addr", c.TunnelAddr, "address of the server tunnel listener")
+	fs.StringVar(&c.Token, "token", c.Token, "auth token")
+	fs.StringVar(&c.CityCode, "city-code", c.CityCode, "city code of this exit node")
+	fs.Float64Var(&c.GpsLat, "gps-lat", c.GpsLat, "latitude of this exit node")
+	fs.Float64Var(&c.GpsLng, "gps-lng", c.GpsLng, "longitude of this exit node")
+	fs.StringVar(&c.DeviceIdFile, "device-id-file", c.DeviceIdFile, "file holding the persistent device id")
+	fs.IntVar(&c.Weight, "weight", c.Weight, "share of traffic when the server balances by weight")
+	fs.Var(&c.DailyQuota, "daily-quota", "traffic to relay per day, e.g. 2GB, 0 is unlimited")
+	fs.Var(&c.MonthlyQuota, "monthly-quota", "traffic to relay per month, e.g. 30GB, 0 is unlimited")
+	fs.IntVar(&c.MaxStreams, "max-streams", c.MaxStreams, "concurrent proxied connections to accept, 0 is unlimited")
+	fs.IntVar(&c.MuxSessions, "mux-sessions", c.MuxSessions, "multiplexed sessions to keep open, 0 disables multiplexing")
+	fs.Var(&c.AllowDest, "allow-dest", "comma separated CIDRs, IPs and host globs proxied connections may reach, empty allows all")
+	fs.Var(&c.DenyDest, "deny-dest", "comma separated CIDRs, IPs and host globs proxied connections may not reach")
+	fs.Var(&c.AllowPorts, "allow-ports", "comma separated ports and ranges proxied connections may reach, empty allows all")
+	fs.Var(&c.DenyPorts, "deny-ports", "comma separated ports and ranges proxied connections may not reach")
+	fs.BoolVar(&c.AllowPrivate, "allow-private", c.AllowPrivate, "allow proxied connections to private, loopback and link local addresses")
+	fs.StringVar(&c.Resolver, "resolver", c.Resolver, "resolver of proxied targets: system, a DNS server like 8.8.8.8 or tcp://1.1.1.1:53, or a DoH url")
+	fs.StringVar(&c.IPPreference, "ip-preference", c.IPPreference, "addresses tried first: ipv4 or ipv6, or only: ipv4-only or ipv6-only")
+	fs.BoolVar(&c.HappyEyeballs, "happy-eyeballs", c.HappyEyeballs, "race the addresses of proxied targets instead of trying them in turn")
+	fs.Var(&c.DialTimeout, "dial-timeout", "timeout for connecting to proxied targets")
+	fs.Var(&c.ConnectTimeout, "connect-timeout", "timeout for connecting and authenticating to the server")
+	fs.Var(&c.PingInterval, "ping-interval", "interval between heartbeats")
+	fs.Var(&c.MaxPongLatency, "max-pong-latency", "reconnect when no pong arrives within this time")
+	fs.Var(&c.MinReconnectDelay, "min-reconnect-delay", "initial delay between reconnects")
+	fs.Var(&c.MaxReconnectDelay, "max-reconnect-delay", "maximum delay between reconnects")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "connect to the server over tls")
+	fs.StringVar(&c.TLSCA, "tls-ca", c.TLSCA, "only trust server certificates signed by this CA")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "client certificate file")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "private key file of -tls-cert")
+	fs.StringVar(&c.TLSServerName, "tls-server-name", c.TLSServerName, "server name to verify, defaults to the host of the tunnel address")
+	return fs
+}
+
+// loadConfig builds the config from the command line arguments. It doesn't
+// validate it, so -print-config also shows incomplete configs.
+func loadConfig(args []string) (*Config, *commandFlags, error) {
+	cmd := &commandFlags{}
+
+	// the first pass only finds the config file
+	defaultConfig().flagSet(cmd).Parse(args)
+
+	c := defaultConfig()
+	if cmd.configFile != "" {
+		if err := util.LoadConfig(cmd.configFile, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := util.LoadEnv(c); err != nil {
+		return nil, nil, err
+	}
+	// flags override everything else
+	c.flagSet(cmd).Parse(args)
+	return c, cmd, nil
+}
+
+func (c *Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.TunnelAddr); err != nil {
+		return fmt.Errorf("invalid tunnel address %q: %v", c.TunnelAddr, err)
+	}
+	if c.CityCode == "" {
+		return errors.New("cityCode couldn't be empty")
+	}
+	if c.DeviceIdFile == "" {
+		return errors.New("deviceIdFile couldn't be empty")
+	}
+	if c.Weight <= 0 {
+		return errors.New("weight must be positive")
+	}
+	if c.MaxStreams < 0 {
+		return errors.New("maxStreams must not be negative")
+	}
+	if c.MuxSessions < 0 {
+		return errors.New("muxSessions must not be negative")
+	}
+	for _, d := range []util.Duration{c.DialTimeout, c.ConnectTimeout, c.PingInterval, c.MaxPongLatency, c.MinReconnectDelay, c.MaxReconnectDelay} {
+		if d <= 0 {
+			return errors.New("durations must be positive")
+		}
+	}
+	if c.MinReconnectDelay > c.MaxReconnectDelay {
+		return errors.New("minReconnectDelay must not exceed maxReconnectDelay")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tlsCert and tlsKey must be set together")
+	}
+	switch c.IPPreference {
+	case preferAny, preferIPv4, preferIPv6, onlyIPv4, onlyIPv6:
+	default:
+		return fmt.Errorf("invalid ipPreference %q", c.IPPreference)
+	}
+	if _, err := newResolver(c.Resolver); err != nil {
+		return err
+	}
+	return nil
+}
+
+// useTLS reports whether the tunnel connections use tls.
+func (c *Config) useTLS() bool {
+	return c.TLS || c.TLSCA != "" || c.TLSCert != ""
+}
+
+// print writes the config as json with the secrets masked.
+func (c *Config) print() {
+	b, _ := json.MarshalIndent(util.Redacted(c), "", "  ")
+	fmt.Println(string(b))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// loadDeviceId returns the identity of this device, generating and saving
+// one on first use. The server keeps our client id stable as long as we
+// present the same device id.
+func loadDeviceId(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	if err = ioutil.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
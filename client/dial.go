@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/snaigle/dproxy/msg"
+	"net"
+	"syscall"
+	"time"
+)
+
+// dialAllowed connects to the host:port addr if the policy allows it,
+// trying its addresses in turn or racing them with happy eyeballs.
+func dialAllowed(addr string) (conn net.Conn, err error) {
+	addrs, err := policy.Resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HappyEyeballs && len(addrs) > 1 {
+		return dialHappyEyeballs(addrs, time.Duration(opts.DialTimeout))
+	}
+	for _, a := range addrs {
+		if conn, err = net.DialTimeout("tcp", a, time.Duration(opts.DialTimeout)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialErrorReason classifies a dial error for DialResult, so the server
+// can answer with the matching socks5 reply code.
+func dialErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == errNotAllowed:
+		return msg.DialErrNotAllowed
+	case errors.As(err, &dnsErr):
+		return msg.DialErrHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return msg.DialErrConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return msg.DialErrHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return msg.DialErrNetworkUnreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return msg.DialErrTimeout
+	}
+	return msg.DialErrGeneral
+}
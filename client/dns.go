@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IP preferences, which addresses of a target are tried first or at all
+const (
+	preferAny  = ""
+	preferIPv4 = "ipv4"
+	preferIPv6 = "ipv6"
+	onlyIPv4   = "ipv4-only"
+	onlyIPv6   = "ipv6-only"
+)
+
+// how long a happy eyeballs attempt runs before the next one starts,
+// RFC 8305 section 5
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Resolver looks up the addresses of host names.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// newResolver returns the resolver of spec: "system" or empty for the
+// resolver of the OS, an https url for DNS-over-HTTPS, or the address of a
+// DNS server, queried over udp unless it starts with tcp://.
+func newResolver(spec string) (Resolver, error) {
+	switch {
+	case spec == "" || spec == "system":
+		return netResolver{net.DefaultResolver}, nil
+	case strings.HasPrefix(spec, "https://"):
+		return newDohResolver(spec), nil
+	}
+	network, addr := "udp", spec
+	if strings.HasPrefix(spec, "udp://") {
+		addr = strings.TrimPrefix(spec, "udp://")
+	} else if strings.HasPrefix(spec, "tcp://") {
+		network, addr = "tcp", strings.TrimPrefix(spec, "tcp://")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid resolver %q, the DNS server must be an IP", spec)
+	}
+	return netResolver{&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}, nil
+}
+
+// netResolver resolves with the resolver of the net package.
+type netResolver struct {
+	*net.Resolver
+}
+
+func (r netResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// dohResolver resolves with DNS-over-HTTPS, RFC 8484, over the network of
+// the exit node.
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func newDohResolver(url string) *dohResolver {
+	return &dohResolver{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// LookupIP queries the A and AAAA records at the same time, IPv4 addresses
+// come first like with the OS resolver.
+func (r *dohResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([][]net.IP, len(types))
+	errs := make(chan error, len(types))
+	for i, t := range types {
+		go func(i int, t dnsmessage.Type) {
+			var err error
+			results[i], err = r.query(ctx, host, t)
+			errs <- err
+		}(i, t)
+	}
+	var err error
+	for range types {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	var ips []net.IP
+	for _, r := range results {
+		ips = append(ips, r...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+func (r *dohResolver) query(ctx context.Context, host string, t dnsmessage.Type) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	// the id is 0 so responses can be cached, section 4.1
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &net.DNSError{Err: "DoH server answered " + resp.Status, Name: host, IsTemporary: true}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(body)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, &net.DNSError{Err: "server answered " + h.RCode.String(), Name: host}
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host}
+		}
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(a.AAAA[:]))
+		default:
+			// CNAMEs are followed by the server
+			if err = p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ips, nil
+}
+
+// orderIPs orders the addresses of a target by preference, leaving out
+// the other family for the -only preferences. For happy eyeballs the
+// families alternate, starting with the preferred one.
+func orderIPs(ips []net.IP, preference string, interleave bool) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	var first, second []net.IP
+	switch preference {
+	case onlyIPv4:
+		return v4
+	case onlyIPv6:
+		return v6
+	case preferIPv4:
+		first, second = v4, v6
+	case preferIPv6:
+		first, second = v6, v4
+	default:
+		if !interleave {
+			return ips
+		}
+		first, second = v4, v6
+		if len(ips) > 0 && ips[0].To4() == nil {
+			first, second = v6, v4
+		}
+	}
+	if !interleave {
+		return append(first, second...)
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialHappyEyeballs connects to the first of addrs that answers, starting
+// an attempt every happyEyeballsDelay or as soon as the previous one fails,
+// RFC 8305.
+func dialHappyEyeballs(addrs []string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		var d net.Dialer
+		go func(addr string) {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}(addrs[next])
+		next++
+		pending++
+	}
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	err := errors.New("no address to connect to")
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of attempts that win later
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(addrs) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, err
+}
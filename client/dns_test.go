@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseIPs(addrs ...string) []net.IP {
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = net.ParseIP(a)
+	}
+	return ips
+}
+
+func TestOrderIPs(t *testing.T) {
+	mixed := parseIPs("1.1.1.1", "2.2.2.2", "::1", "::2", "::3")
+	v6first := parseIPs("::1", "1.1.1.1", "::2")
+	tests := []struct {
+		ips        []net.IP
+		preference string
+		interleave bool
+		want       []net.IP
+	}{
+		{mixed, preferAny, false, mixed},
+		{v6first, preferAny, false, v6first},
+		{mixed, preferIPv4, false, mixed},
+		{mixed, preferIPv6, false, parseIPs("::1", "::2", "::3", "1.1.1.1", "2.2.2.2")},
+		{mixed, onlyIPv4, false, parseIPs("1.1.1.1", "2.2.2.2")},
+		{mixed, onlyIPv6, true, parseIPs("::1", "::2", "::3")},
+		{parseIPs("1.1.1.1"), onlyIPv6, false, nil},
+		{mixed, preferAny, true, parseIPs("1.1.1.1", "::1", "2.2.2.2", "::2", "::3")},
+		{v6first, preferAny, true, parseIPs("::1", "1.1.1.1", "::2")},
+		{mixed, preferIPv6, true, parseIPs("::1", "1.1.1.1", "::2", "2.2.2.2", "::3")},
+		{parseIPs("::ffff:1.1.1.1", "::1"), preferIPv6, false, parseIPs("::1", "::ffff:1.1.1.1")},
+		{nil, preferAny, true, []net.IP{}},
+	}
+	for _, tt := range tests {
+		got := orderIPs(tt.ips, tt.preference, tt.interleave)
+		if len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orderIPs(%v, %q, %v) = %v, want %v", tt.ips, tt.preference, tt.interleave, got, tt.want)
+		}
+	}
+}
+
+// dohAnswer builds the response of a DoH server to query.
+func dohAnswer(t *testing.T, query []byte, rcode dnsmessage.RCode, answers map[dnsmessage.Type][]dnsmessage.Resource) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	h.Response, h.RCode = true, rcode
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, r := range answers[q.Type] {
+		r.Header.Name, r.Header.Class = q.Name, dnsmessage.ClassINET
+		switch body := r.Body.(type) {
+		case *dnsmessage.AResource:
+			b.AResource(r.Header, *body)
+		case *dnsmessage.AAAAResource:
+			b.AAAAResource(r.Header, *body)
+		case *dnsmessage.CNAMEResource:
+			b.CNAMEResource(r.Header, *body)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return msg
+}
+
+func TestDohResolver(t *testing.T) {
+	a := func(ip string) dnsmessage.Resource {
+		var r dnsmessage.AResource
+		copy(r.A[:], net.ParseIP(ip).To4())
+		return dnsmessage.Resource{Body: &r}
+	}
+	aaaa := func(ip string) dnsmessage.Resource {
+		var r dnsmessage.AAAAResource
+		copy(r.AAAA[:], net.ParseIP(ip))
+		return dnsmessage.Resource{Body: &r}
+	}
+	cname := dnsmessage.Resource{Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("edge.example.net.")}}
+
+	tests := []struct {
+		host    string
+		status  int
+		rcode   dnsmessage.RCode
+		answers map[dnsmessage.Type][]dnsmessage.Resource
+		want    []net.IP
+		err     string
+	}{
+		{"example.com", http.StatusOK, dnsmessage.RCodeSuccess, map[dnsmessage.Type][]dnsmessage.Resource{
+			dnsmessage.TypeA:    {a("93.184.216.34")},
+			dnsmessage.TypeAAAA: {aaaa("2606:2800:220:1::1")},
+		}, parseIPs("93.184.216.34", "2606:2800:220:1::1"), ""},
+		{"www.example.com.", http.StatusOK, dnsmessage.RCodeSuccess, map[dnsmessage.Type][]dnsmessage.Resource{
+			dnsmessage.TypeA: {cname, a("1.1.1.1"), a("2.2.2.2")},
+		}, parseIPs("1.1.1.1", "2.2.2.2"), ""},
+		{"v6.example.com", http.StatusOK, dnsmessage.RCodeSuccess, map[dnsmessage.Type][]dnsmessage.Resource{
+			dnsmessage.TypeAAAA: {aaaa("::1")},
+		}, parseIPs("::1"), ""},
+		{"missing.example.com", http.StatusOK, dnsmessage.RCodeNameError, nil, nil, "no such host"},
+		{"empty.example.com", http.StatusOK, dnsmessage.RCodeSuccess, nil, nil, "no such host"},
+		{"broken.example.com", http.StatusOK, dnsmessage.RCodeServerFailure, nil, nil, "server answered RCodeServerFailure"},
+		{"example.com", http.StatusBadRequest, dnsmessage.RCodeSuccess, nil, nil, "DoH server answered 400"},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+				t.Errorf("got a %s request of %s", r.Method, r.Header.Get("Content-Type"))
+			}
+			if tt.status != http.StatusOK {
+				w.WriteHeader(tt.status)
+				return
+			}
+			query, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(dohAnswer(t, query, tt.rcode, tt.answers))
+		}))
+		ips, err := newDohResolver(srv.URL).LookupIP(context.Background(), tt.host)
+		srv.Close()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("LookupIP(%s) = %v, %v, want error %q", tt.host, ips, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(ips) != fmt.Sprint(tt.want) {
+			t.Errorf("LookupIP(%s) = %v, %v, want %v", tt.host, ips, err, tt.want)
+		}
+	}
+}
+
+func TestDohResolverGarbage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not dns</html>"))
+	}))
+	defer srv.Close()
+	if ips, err := newDohResolver(srv.URL).LookupIP(context.Background(), "example.com"); err == nil {
+		t.Fatalf("parsed %v from garbage", ips)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"", true},
+		{"system", true},
+		{"8.8.8.8", true},
+		{"8.8.8.8:5353", true},
+		{"tcp://1.1.1.1:53", true},
+		{"udp://[2001:4860:4860::8888]", true},
+		{"2001:4860:4860::8888", true},
+		{"https://dns.google/dns-query", true},
+		{"dns.google", false},
+		{"tcp://dns.google:53", false},
+	}
+	for _, tt := range tests {
+		if _, err := newResolver(tt.spec); (err == nil) != tt.ok {
+			t.Errorf("newResolver(%q) = %v, want ok %v", tt.spec, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/msg"
+	"log"
+	"time"
+)
+
+// muxSessions keeps opts.MuxSessions multiplexed sessions open to the
+// server until done is closed, re-dialing the ones that fail.
+func muxSessions(clientId, secret string, done chan struct{}) {
+	for i := 0; i < opts.MuxSessions; i++ {
+		go func() {
+			for {
+				err := muxSession(clientId, secret, done)
+				select {
+				case <-done:
+					return
+				default:
+				}
+				log.Println("mux session closed:", err)
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Duration(opts.MinReconnectDelay)):
+				}
+			}
+		}()
+	}
+}
+
+// muxSession registers a single multiplexed session and serves the streams
+// the server opens on it until it fails.
+func muxSession(clientId, secret string, done chan struct{}) error {
+	conn, err := dialTunnel()
+	if err != nil {
+		return err
+	}
+	if err = msg.WriteMsg(conn, &msg.RegMux{ClientId: clientId, Secret: secret}); err != nil {
+		conn.Close()
+		return err
+	}
+	sess := msg.NewSession(conn, true, true)
+	go func() {
+		select {
+		case <-done:
+		case <-sess.CloseChan():
+		}
+		sess.Close()
+	}()
+	log.Println("mux session established:", clientId)
+
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return err
+		}
+		go handleProxy(stream)
+	}
+}
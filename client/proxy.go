@@ -1,68 +1,172 @@
 package main
 
 import (
+	"fmt"
 	"github.com/snaigle/dproxy/msg"
 	"github.com/snaigle/dproxy/util"
 	"log"
+	"math/rand"
 	"net"
+	"os"
 	"sync/atomic"
 	"time"
 )
 
-const (
-	pingInterval   = 5 * time.Second
-	maxPongLatency = 15 * time.Second
+var (
+	opts     *Config
+	policy   *Policy
+	resolver Resolver
 )
 
-var (
-	tunnelAddr = "127.0.0.1:1091"
-	clientId   string
+// ConnState describes the state of the control connection to the server.
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDisconnected
 )
 
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// onStateChange is called every time the control connection changes state.
+// err is set when the connection is lost.
+var onStateChange = func(state ConnState, clientId string, err error) {
+	if err != nil {
+		log.Printf("control %s: %v\n", state, err)
+	} else if clientId != "" {
+		log.Printf("control %s, client id: %s\n", state, clientId)
+	} else {
+		log.Printf("control %s to %s\n", state, opts.TunnelAddr)
+	}
+}
+
 // 代理
 func main() {
+	var (
+		cmd *commandFlags
+		err error
+	)
+	if opts, cmd, err = loadConfig(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if cmd.printConfig {
+		opts.print()
+		return
+	}
+	if err = opts.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if policy, err = newPolicy(opts); err != nil {
+		log.Fatal(err)
+	}
+	if resolver, err = newResolver(opts.Resolver); err != nil {
+		log.Fatal(err)
+	}
+	if opts.useTLS() {
+		serverName := opts.TLSServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(opts.TunnelAddr)
+		}
+		if tlsConfig, err = loadTLSConfig(opts.TLSCA, opts.TLSCert, opts.TLSKey, serverName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	minDelay, maxDelay := time.Duration(opts.MinReconnectDelay), time.Duration(opts.MaxReconnectDelay)
+	delay := minDelay
+	for {
+		onStateChange(StateConnecting, "", nil)
+		wasConnected, err := control()
+		onStateChange(StateDisconnected, "", err)
+
+		// a session that made it past authentication starts the backoff over
+		if wasConnected {
+			delay = minDelay
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("reconnecting in %v\n", wait)
+		time.Sleep(wait)
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
 
+// control runs a single control connection until it fails. wasConnected
+// reports whether the server accepted the client before the failure.
+func control() (wasConnected bool, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("control recovering from failure ", r)
+			err = fmt.Errorf("control recovering from failure %v", r)
 		}
 	}()
 
-	var (
-		ctlConn net.Conn
-		err     error
-	)
-	if ctlConn, err = net.Dial("tcp", tunnelAddr); err != nil {
-		panic(err)
+	deviceId, err := loadDeviceId(opts.DeviceIdFile)
+	if err != nil {
+		return
+	}
+	var ctlConn net.Conn
+	if ctlConn, err = dialTunnel(); err != nil {
+		return
 	}
 	defer ctlConn.Close()
 	auth := &msg.Auth{
-		Token:    "authToken",
-		CityCode: "110000",
+		ProtoVersion: msg.Version,
+		Token:        opts.Token,
+		CityCode:     opts.CityCode,
+		GpsLat:       opts.GpsLat,
+		GpsLit:       opts.GpsLng,
+		DeviceId:     deviceId,
+		Weight:       opts.Weight,
+		DailyQuota:   int64(opts.DailyQuota),
+		MonthlyQuota: int64(opts.MonthlyQuota),
+		MaxStreams:   opts.MaxStreams,
 	}
+	// a server that stalls during authentication is treated as lost
+	ctlConn.SetDeadline(time.Now().Add(time.Duration(opts.ConnectTimeout)))
 	if err = msg.WriteMsg(ctlConn, auth); err != nil {
-		panic(err)
+		return
 	}
 	var authResp msg.AuthResp
 	if err = msg.ReadMsgInto(ctlConn, &authResp); err != nil {
-		panic(err)
+		return
 	}
+	ctlConn.SetDeadline(time.Time{})
 	if authResp.Error != "" {
-		log.Println("Failed to authenticate to server:", authResp.Error)
+		err = fmt.Errorf("failed to authenticate to server: %s", authResp.Error)
 		return
 	}
-	clientId = authResp.ClientId
-	log.Println("authenticated with server: client id:", clientId)
+	wasConnected = true
+	clientId, secret := authResp.ClientId, authResp.Secret
+	onStateChange(StateConnected, clientId, nil)
+
 	lastPong := time.Now().UnixNano()
-	go heartbeat(&lastPong, ctlConn)
+	done := make(chan struct{})
+	defer close(done)
+	go heartbeat(&lastPong, ctlConn, done)
+	if opts.MuxSessions > 0 {
+		muxSessions(clientId, secret, done)
+	}
 	for {
 		var rawMsg msg.Message
 		if rawMsg, err = msg.ReadMsg(ctlConn); err != nil {
-			panic(err)
+			return
 		}
 		switch m := rawMsg.(type) {
 		case *msg.ReqProxy:
-			go proxy()
+			go proxy(clientId, secret)
 		case *msg.Pong:
 			atomic.StoreInt64(&lastPong, time.Now().UnixNano())
 		default:
@@ -71,9 +175,9 @@ func main() {
 	}
 }
 
-func heartbeat(lastPongAddr *int64, conn net.Conn) {
+func heartbeat(lastPongAddr *int64, conn net.Conn, done chan struct{}) {
 	lastPing := time.Unix(atomic.LoadInt64(lastPongAddr)-1, 0)
-	ping := time.NewTicker(pingInterval)
+	ping := time.NewTicker(time.Duration(opts.PingInterval))
 	pongCheck := time.NewTicker(time.Second)
 
 	defer func() {
@@ -84,19 +188,27 @@ func heartbeat(lastPongAddr *int64, conn net.Conn) {
 
 	for {
 		select {
+		case <-done:
+			return
+
 		case <-pongCheck.C:
 			lastPong := time.Unix(0, atomic.LoadInt64(lastPongAddr))
 			needPong := lastPong.Sub(lastPing) < 0
 			pongLatency := time.Since(lastPing)
 
-			if needPong && pongLatency > maxPongLatency {
+			if needPong && pongLatency > time.Duration(opts.MaxPongLatency) {
 				log.Printf("Last ping: %v, Last pong: %v\n", lastPing, lastPong)
 				log.Printf("Connection stale, haven't gotten PongMsg in %d seconds\n", int(pongLatency.Seconds()))
 				return
 			}
 
 		case <-ping.C:
-			err := msg.WriteMsg(conn, &msg.Ping{})
+			// report how long the previous ping took to be answered
+			var rtt int64
+			if lastPong := time.Unix(0, atomic.LoadInt64(lastPongAddr)); lastPong.After(lastPing) {
+				rtt = int64(lastPong.Sub(lastPing) / time.Microsecond)
+			}
+			err := msg.WriteMsg(conn, &msg.Ping{Rtt: rtt})
 			if err != nil {
 				log.Printf("Got error %v when writing PingMsg \n", err)
 				return
@@ -106,35 +218,64 @@ func heartbeat(lastPongAddr *int64, conn net.Conn) {
 	}
 }
 
-func proxy() {
+func proxy(clientId, secret string) {
 	var (
 		remoteConn net.Conn
 		err        error
 	)
 	log.Println("start proxy:", clientId)
-	remoteConn, err = net.Dial("tcp", tunnelAddr)
+	remoteConn, err = dialTunnel()
 	if err != nil {
 		log.Println("Failed to connect proxy connection:", err)
 		return
 	}
 	defer remoteConn.Close()
-	err = msg.WriteMsg(remoteConn, &msg.RegProxy{ClientId: clientId})
+	err = msg.WriteMsg(remoteConn, &msg.RegProxy{ClientId: clientId, Secret: secret})
 	if err != nil {
 		log.Println("Failed to write regProxy:", err)
 		return
 	}
-	var startProxy msg.StartProxy
-	if err = msg.ReadMsgInto(remoteConn, &startProxy); err != nil {
+	handleProxy(remoteConn)
+}
+
+// handleProxy serves a proxy connection or stream: it waits for the server
+// to say what the connection is for and then relays it.
+func handleProxy(remoteConn net.Conn) {
+	defer remoteConn.Close()
+	rawMsg, err := msg.ReadMsg(remoteConn)
+	if err != nil {
 		log.Println("server failed to write startProxy:", err)
 		return
 	}
+	switch m := rawMsg.(type) {
+	case *msg.StartProxy:
+		proxyTcp(remoteConn, m)
+	case *msg.StartUdpRelay:
+		relayUdp(remoteConn)
+	case *msg.StartBind:
+		bind(remoteConn, m)
+	default:
+		log.Printf("Ignoring unknown proxy message %v\n", m)
+	}
+}
+
+func proxyTcp(remoteConn net.Conn, startProxy *msg.StartProxy) {
 	log.Println("start to connect :", startProxy.ClientAddr)
-	localConn, err := net.Dial("tcp", startProxy.ClientAddr)
+	localConn, err := dialAllowed(startProxy.ClientAddr)
 	if err != nil {
 		log.Printf("Failed to open local conn %s,%v\n", startProxy.ClientAddr, err)
+		msg.WriteMsg(remoteConn, &msg.DialResult{Error: err.Error(), Reason: dialErrorReason(err)})
 		return
 	}
 	defer localConn.Close()
+	result := &msg.DialResult{
+		Addr:       localConn.LocalAddr().String(),
+		RemoteAddr: localConn.RemoteAddr().String(),
+	}
+	if err = msg.WriteMsg(remoteConn, result); err != nil {
+		log.Println("Failed to write dial result:", err)
+		return
+	}
 	go util.PipeThenClose(remoteConn, localConn)
 	util.PipeThenClose(localConn, remoteConn)
 }
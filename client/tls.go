@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/snaigle/dproxy/util"
+	"net"
+	"time"
+)
+
+var (
+	// tls config of the tunnel connections, nil for plaintext
+	tlsConfig *tls.Config
+)
+
+// loadTLSConfig builds the client tls config. When caFile is set only
+// servers with a certificate signed by that CA are trusted; certFile and
+// keyFile hold the optional client certificate.
+func loadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	var err error
+	if caFile != "" {
+		if config.RootCAs, err = util.LoadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dialTunnel opens a control or proxy connection to the server, the tls
+// handshake included.
+func dialTunnel() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(opts.ConnectTimeout)}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", opts.TunnelAddr, tlsConfig)
+	}
+	return dialer.Dial("tcp", opts.TunnelAddr)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/msg"
+	"log"
+	"net"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// relayUdp serves a UDP association: datagrams the server relays over
+// remoteConn are sent from a local UDP socket, and whatever that socket
+// receives is relayed back, until remoteConn closes.
+func relayUdp(remoteConn net.Conn) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		log.Println("Failed to listen udp:", err)
+		return
+	}
+	defer pc.Close()
+	log.Println("start udp relay on", pc.LocalAddr())
+
+	go func() {
+		defer remoteConn.Close()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if err = msg.WriteMsg(remoteConn, &msg.Datagram{Addr: addr.String(), Data: buf[:n]}); err != nil {
+				return
+			}
+		}
+	}()
+
+	// destinations are usually few, don't resolve them for every datagram
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		var d msg.Datagram
+		if err = msg.ReadMsgInto(remoteConn, &d); err != nil {
+			return
+		}
+		addr := resolved[d.Addr]
+		if addr == nil {
+			// the policy checks the destination once, when resolving it
+			addrs, err := policy.Resolve(d.Addr)
+			if err != nil {
+				log.Printf("Failed to resolve %s: %v\n", d.Addr, err)
+				continue
+			}
+			if addr, err = net.ResolveUDPAddr("udp", addrs[0]); err != nil {
+				continue
+			}
+			if len(resolved) > 1024 {
+				resolved = make(map[string]*net.UDPAddr)
+			}
+			resolved[d.Addr] = addr
+		}
+		if _, err = pc.WriteTo(d.Data, addr); err != nil {
+			log.Printf("Failed to send datagram to %s: %v\n", d.Addr, err)
+		}
+	}
+}
@@ -1,3 +1,12 @@
 module github.com/snaigle/dproxy
 
-require golang.org/x/net v0.0.0-20190324223953-e3b2ff56ed87
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.21.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require golang.org/x/sys v0.18.0 // indirect
@@ -4,9 +4,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 )
 
+// MaxMsgSize bounds the length a peer may announce for a message. The
+// largest ones carry a datagram, anything longer is refused before it is
+// allocated, authenticated or not.
+const MaxMsgSize = 256 * 1024
+
 func readMsgShared(c net.Conn) (buffer []byte, err error) {
 
 	var sz int64
@@ -14,16 +20,16 @@ func readMsgShared(c net.Conn) (buffer []byte, err error) {
 	if err != nil {
 		return
 	}
+	if sz < 0 || sz > MaxMsgSize {
+		err = fmt.Errorf("message size %d out of range 0-%d", sz, MaxMsgSize)
+		return
+	}
 
 	buffer = make([]byte, sz)
-	n, err := c.Read(buffer)
+	n, err := io.ReadFull(c, buffer)
 
 	if err != nil {
-		return
-	}
-
-	if int64(n) != sz {
-		err = errors.New(fmt.Sprintf("Expected to read %d bytes, but only read %d", sz, n))
+		err = errors.New(fmt.Sprintf("Expected to read %d bytes, but only read %d: %v", sz, n, err))
 		return
 	}
 
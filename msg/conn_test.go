@@ -0,0 +1,43 @@
+package msg
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadMsg(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go WriteMsg(c, &Auth{ProtoVersion: Version, Token: "t", CityCode: "110000"})
+	m, err := ReadMsg(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth, ok := m.(*Auth); !ok || auth.Token != "t" || auth.CityCode != "110000" {
+		t.Fatalf("read %#v", m)
+	}
+
+	// the largest messages carry a datagram
+	go WriteMsg(c, &Datagram{Addr: "127.0.0.1:53", Data: make([]byte, 64*1024)})
+	var d Datagram
+	if err = ReadMsgInto(s, &d); err != nil || len(d.Data) != 64*1024 {
+		t.Fatalf("read a datagram of %d bytes: %v", len(d.Data), err)
+	}
+}
+
+func TestReadMsgSize(t *testing.T) {
+	tests := []int64{-1, MaxMsgSize + 1, 1 << 62}
+	for _, sz := range tests {
+		c, s := net.Pipe()
+		go binary.Write(c, binary.LittleEndian, sz)
+		_, err := ReadMsg(s)
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("message of %d bytes got %v, want out of range", sz, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
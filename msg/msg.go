@@ -5,6 +5,10 @@ import (
 	"reflect"
 )
 
+// Version is the protocol version spoken by this package. Clients send it
+// in Auth.ProtoVersion and the server refuses clients that speak another one.
+const Version = "3"
+
 var TypeMap map[string]reflect.Type
 
 func init() {
@@ -14,8 +18,14 @@ func init() {
 	TypeMap["Auth"] = t((*Auth)(nil))
 	TypeMap["AuthResp"] = t((*AuthResp)(nil))
 	TypeMap["RegProxy"] = t((*RegProxy)(nil))
+	TypeMap["RegMux"] = t((*RegMux)(nil))
 	TypeMap["ReqProxy"] = t((*ReqProxy)(nil))
 	TypeMap["StartProxy"] = t((*StartProxy)(nil))
+	TypeMap["DialResult"] = t((*DialResult)(nil))
+	TypeMap["StartUdpRelay"] = t((*StartUdpRelay)(nil))
+	TypeMap["Datagram"] = t((*Datagram)(nil))
+	TypeMap["StartBind"] = t((*StartBind)(nil))
+	TypeMap["BindResult"] = t((*BindResult)(nil))
 	TypeMap["Ping"] = t((*Ping)(nil))
 	TypeMap["Pong"] = t((*Pong)(nil))
 }
@@ -33,8 +43,13 @@ type Auth struct {
 	ProtoVersion string  // protocol version
 	Token        string  // token
 	CityCode     string  // city code
+	DeviceId     string  // persistent device identity, the server reuses its client id across reconnects
 	GpsLat       float64 //
 	GpsLit       float64 //
+	Weight       int     // share of traffic for weighted balancing, 0 counts as 1
+	DailyQuota   int64   // bytes the client relays per day, 0 is unlimited
+	MonthlyQuota int64   // bytes the client relays per month, 0 is unlimited
+	MaxStreams   int     // concurrent proxied connections, 0 is unlimited
 }
 
 // A server responds to an Auth message with an
@@ -45,11 +60,14 @@ type Auth struct {
 // the new session and will close the connection.
 //
 // The server response includes a unique ClientId
-// that is used to associate and authenticate future
-// proxy connections via the same field in RegProxy messages.
+// that is used to associate future proxy connections
+// via the same field in RegProxy messages, and a Secret
+// which authenticates them. Client ids are public, the
+// secret proves a connection belongs to the client.
 type AuthResp struct {
 	Version  string
 	ClientId string
+	Secret   string
 	Error    string
 }
 
@@ -63,6 +81,16 @@ type ReqProxy struct {
 // connection to the server and sends a RegProxy message.
 type RegProxy struct {
 	ClientId string
+	Secret   string
+}
+
+// A client in multiplexed mode opens a connection to the server and sends
+// a RegMux message instead of answering ReqProxy messages. Both sides then
+// run a Session over the connection and the server opens a stream for
+// each proxied connection, which starts with a StartProxy message.
+type RegMux struct {
+	ClientId string
+	Secret   string
 }
 
 // This message is sent by the server to the client over a *proxy* connection before it
@@ -72,10 +100,66 @@ type StartProxy struct {
 	ClientAddr string // Network address of the client initiating the connection to the tunnel
 }
 
+// Reasons a client gives in DialResult for failing to connect.
+const (
+	DialErrGeneral            = "general"
+	DialErrNetworkUnreachable = "network-unreachable"
+	DialErrHostUnreachable    = "host-unreachable"
+	DialErrConnRefused        = "connection-refused"
+	DialErrTimeout            = "timeout"
+	DialErrNotAllowed         = "not-allowed" // rejected by the policy of the client
+)
+
+// After a client receives StartProxy it connects to ClientAddr and answers
+// with a DialResult before relaying any bytes. If Error is not the empty
+// string the connection failed for the given Reason and the client closes
+// the proxy connection. Otherwise Addr is the local address of the
+// client's connection to ClientAddr and RemoteAddr the address the client
+// resolved ClientAddr to and connected to.
+type DialResult struct {
+	Addr       string
+	RemoteAddr string
+	Error      string
+	Reason     string
+}
+
+// This message is sent by the server instead of StartProxy to turn a proxy
+// connection into a datagram relay for a SOCKS5 UDP ASSOCIATE. Afterwards
+// both sides exchange Datagram messages over the connection; the client sends
+// them from a UDP socket in its own network.
+type StartUdpRelay struct {
+}
+
+// A single UDP datagram relayed over a proxy connection. Going to the
+// client Addr is the destination, coming from the client it is the source.
+type Datagram struct {
+	Addr string
+	Data []byte
+}
+
+// This message is sent by the server instead of StartProxy for a SOCKS5
+// BIND request. The client listens on a port in its own network and answers
+// with two BindResult messages: one once it listens and one once the
+// inbound connection from ClientAddr arrives. The proxy connection then
+// carries that inbound connection.
+type StartBind struct {
+	ClientAddr string // address the inbound connection is expected from
+}
+
+// Sent by the client in answer to StartBind. Addr is the listening address
+// in the first message and the address of the inbound peer in the second.
+// If Error is not the empty string the bind failed and the client closes
+// the connection.
+type BindResult struct {
+	Addr  string
+	Error string
+}
+
 // A client or server may send this message periodically over
 // the control channel to request that the remote side acknowledge
 // its connection is still alive. The remote side must respond with a Pong.
 type Ping struct {
+	Rtt int64 // round trip time of the previous ping in microseconds, 0 if unknown
 }
 
 // Sent by a client or server over the control channel to indicate
@@ -0,0 +1,581 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Session multiplexes many logical streams over a single connection, so
+// a proxied connection doesn't cost a new tunnel connection. The framing
+// follows yamux: every frame starts with a 12 byte header
+//
+//	version(1) type(1) flags(2) stream id(4) length(4)
+//
+// followed by length bytes of payload for data frames. Each stream has its
+// own receive window; the receiver grants more window with window update
+// frames as the application consumes data, so one slow stream can't stall
+// the others.
+
+const (
+	muxVersion    = 0
+	muxHeaderSize = 12
+
+	muxTypeData         = 0
+	muxTypeWindowUpdate = 1
+	muxTypePing         = 2
+	muxTypeGoAway       = 3
+
+	muxFlagSYN = 1 // opens a stream
+	muxFlagACK = 2 // acknowledges a stream or ping
+	muxFlagFIN = 4 // half-closes a stream
+	muxFlagRST = 8 // resets a stream
+
+	muxInitialWindow  = 256 * 1024
+	muxMaxFrameSize   = 16 * 1024
+	muxAcceptBacklog  = 256
+	muxWriteTimeout   = 10 * time.Second
+	muxKeepalive      = 30 * time.Second
+	muxStreamLinger   = 60 * time.Second
+	muxMaxMissedPings = 3
+)
+
+var (
+	ErrSessionClosed = errors.New("mux session closed")
+	ErrStreamClosed  = errors.New("mux stream closed")
+	ErrStreamReset   = errors.New("mux stream reset by peer")
+	errMuxNoAccept   = errors.New("mux session refuses streams")
+	errMuxTimeout    = &muxTimeoutError{}
+)
+
+type muxTimeoutError struct{}
+
+func (e *muxTimeoutError) Error() string   { return "mux i/o timeout" }
+func (e *muxTimeoutError) Timeout() bool   { return true }
+func (e *muxTimeoutError) Temporary() bool { return true }
+
+type muxHeader [muxHeaderSize]byte
+
+func (h *muxHeader) encode(typ uint8, flags uint16, id uint32, length uint32) {
+	h[0] = muxVersion
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func (h *muxHeader) typ() uint8       { return h[1] }
+func (h *muxHeader) flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h *muxHeader) streamId() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h *muxHeader) length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+type Session struct {
+	conn net.Conn
+
+	// the id of the next stream we open, odd for clients, even for servers
+	nextId uint32
+
+	streams map[uint32]*Stream
+	accept  chan *Stream // nil if streams of the peer are refused
+
+	// the time we last heard anything from the peer, for keepalives
+	lastRecv time.Time
+
+	writeLock sync.Mutex
+	sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession starts multiplexing over conn. The two ends of a connection
+// must pass different values for client. Streams the peer opens wait for
+// Accept if accept is set, otherwise they are reset right away; an end
+// that never calls Accept must not set it, or they pile up unread.
+func NewSession(conn net.Conn, client, accept bool) *Session {
+	s := &Session{
+		conn:     conn,
+		nextId:   2,
+		streams:  make(map[uint32]*Stream),
+		lastRecv: time.Now(),
+		closed:   make(chan struct{}),
+	}
+	if client {
+		s.nextId = 1
+	}
+	if accept {
+		s.accept = make(chan *Stream, muxAcceptBacklog)
+	}
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+// Open opens a new stream to the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.Lock()
+	if s.IsClosed() {
+		s.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextId
+	s.nextId += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.Unlock()
+
+	if err := s.writeFrame(muxTypeWindowUpdate, muxFlagSYN, id, 0, nil); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	if s.accept == nil {
+		return nil, errMuxNoAccept
+	}
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Close closes the session and every stream on it.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.writeFrame(muxTypeGoAway, 0, 0, 0, nil)
+		close(s.closed)
+		s.conn.Close()
+		s.Lock()
+		for _, st := range s.streams {
+			st.notify()
+		}
+		s.streams = make(map[uint32]*Stream)
+		s.Unlock()
+	})
+	return nil
+}
+
+// CloseChan is closed once the session is closed.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) writeFrame(typ uint8, flags uint16, id uint32, length uint32, body []byte) error {
+	var hdr muxHeader
+	hdr.encode(typ, flags, id, length)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		go s.Close()
+		return err
+	}
+	if len(body) > 0 {
+		if _, err := s.conn.Write(body); err != nil {
+			go s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) forget(id uint32) {
+	s.Lock()
+	delete(s.streams, id)
+	s.Unlock()
+}
+
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(muxKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Lock()
+			idle := time.Since(s.lastRecv)
+			s.Unlock()
+			if idle > muxMaxMissedPings*muxKeepalive {
+				s.Close()
+				return
+			}
+			s.writeFrame(muxTypePing, muxFlagSYN, 0, 0, nil)
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	var hdr muxHeader
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			return
+		}
+		if hdr[0] != muxVersion {
+			return
+		}
+		s.Lock()
+		s.lastRecv = time.Now()
+		s.Unlock()
+
+		var err error
+		switch hdr.typ() {
+		case muxTypeData, muxTypeWindowUpdate:
+			err = s.handleStreamFrame(&hdr)
+		case muxTypePing:
+			if hdr.flags()&muxFlagSYN != 0 {
+				go s.writeFrame(muxTypePing, muxFlagACK, 0, 0, nil)
+			}
+		case muxTypeGoAway:
+			return
+		default:
+			err = fmt.Errorf("unknown mux frame type %d", hdr.typ())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Session) handleStreamFrame(hdr *muxHeader) error {
+	id, flags := hdr.streamId(), hdr.flags()
+
+	s.Lock()
+	st := s.streams[id]
+	if st == nil && flags&muxFlagSYN != 0 {
+		st = newStream(s, id)
+		select {
+		case s.accept <- st:
+			s.streams[id] = st
+		default:
+			// accept backlog full or nobody accepts, refuse the stream
+			st = nil
+			go s.writeFrame(muxTypeWindowUpdate, muxFlagRST, id, 0, nil)
+		}
+	}
+	s.Unlock()
+
+	if hdr.typ() == muxTypeData {
+		length := hdr.length()
+		if length > muxInitialWindow {
+			return fmt.Errorf("mux frame of %d bytes exceeds the window", length)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, body); err != nil {
+			return err
+		}
+		if st != nil {
+			if err := st.receive(body); err != nil {
+				return err
+			}
+		}
+	} else if st != nil && hdr.length() > 0 {
+		st.grantWindow(hdr.length())
+	}
+
+	if st != nil {
+		if flags&muxFlagFIN != 0 {
+			st.remoteClose()
+		}
+		if flags&muxFlagRST != 0 {
+			st.reset()
+		}
+	}
+	return nil
+}
+
+// Stream is a logical connection inside a Session. It implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	// data received from the peer that hasn't been read yet
+	recvBuf bytes.Buffer
+	// how many more bytes the peer may send us
+	recvWindow uint32
+	// bytes consumed by Read which we haven't granted back to the peer yet
+	consumed uint32
+
+	// how many more bytes we may send to the peer
+	sendWindow uint32
+
+	localClosed  bool // we sent a FIN
+	remoteClosed bool // the peer sent a FIN
+	wasReset     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// signalled whenever any of the above changes, one channel for
+	// readers and one for writers so they can't steal each other's wakeup
+	readReady  chan struct{}
+	writeReady chan struct{}
+
+	sync.Mutex
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) notify() {
+	select {
+	case st.readReady <- struct{}{}:
+	default:
+	}
+	select {
+	case st.writeReady <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until the stream changes, the deadline passes or the session
+// closes. It must be called without holding the lock.
+func (st *Stream) wait(ready chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errMuxTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		return errMuxTimeout
+	case <-st.session.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (st *Stream) receive(body []byte) error {
+	st.Lock()
+	defer st.Unlock()
+	if uint32(len(body)) > st.recvWindow {
+		return fmt.Errorf("mux stream %d overran its window", st.id)
+	}
+	st.recvWindow -= uint32(len(body))
+	if st.localClosed {
+		// nobody will read it, but keep the peer's window open
+		st.consumed += uint32(len(body))
+		st.sendWindowUpdate()
+	} else {
+		st.recvBuf.Write(body)
+	}
+	st.notify()
+	return nil
+}
+
+func (st *Stream) grantWindow(delta uint32) {
+	st.Lock()
+	st.sendWindow += delta
+	st.Unlock()
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.Unlock()
+	st.notify()
+	if done {
+		st.session.forget(st.id)
+	}
+}
+
+func (st *Stream) reset() {
+	st.Lock()
+	st.wasReset = true
+	st.Unlock()
+	st.notify()
+	st.session.forget(st.id)
+}
+
+// sendWindowUpdate grants the peer the window consumed so far once it is
+// large enough to be worth a frame. Called with the lock held.
+func (st *Stream) sendWindowUpdate() {
+	if st.consumed < muxInitialWindow/2 {
+		return
+	}
+	delta := st.consumed
+	st.consumed = 0
+	st.recvWindow += delta
+	go st.session.writeFrame(muxTypeWindowUpdate, 0, st.id, delta, nil)
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.Lock()
+		switch {
+		case st.recvBuf.Len() > 0:
+			n, _ = st.recvBuf.Read(b)
+			st.consumed += uint32(n)
+			st.sendWindowUpdate()
+			st.Unlock()
+			return
+		case st.wasReset:
+			err = ErrStreamReset
+		case st.localClosed:
+			err = ErrStreamClosed
+		case st.remoteClosed:
+			err = io.EOF
+		}
+		deadline := st.readDeadline
+		st.Unlock()
+		if err != nil {
+			return
+		}
+		if err = st.wait(st.readReady, deadline); err != nil {
+			return
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.Lock()
+		switch {
+		case st.wasReset:
+			err = ErrStreamReset
+		case st.localClosed:
+			err = ErrStreamClosed
+		}
+		size := st.sendWindow
+		if size > muxMaxFrameSize {
+			size = muxMaxFrameSize
+		}
+		if size > uint32(len(b)) {
+			size = uint32(len(b))
+		}
+		st.sendWindow -= size
+		deadline := st.writeDeadline
+		st.Unlock()
+		if err != nil {
+			return
+		}
+		if size == 0 {
+			// wait for the peer to grant us more window
+			if err = st.wait(st.writeReady, deadline); err != nil {
+				return
+			}
+			continue
+		}
+		if err = st.session.writeFrame(muxTypeData, 0, st.id, size, b[:size]); err != nil {
+			return
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return
+}
+
+// Close half-closes the stream by sending a FIN. The stream is forgotten
+// once the peer closes its side too, or reset if it doesn't in time.
+func (st *Stream) Close() error {
+	st.Lock()
+	if st.localClosed || st.wasReset {
+		st.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	// data we won't read anymore is given back to the peer
+	st.consumed += uint32(st.recvBuf.Len())
+	st.recvBuf.Reset()
+	st.sendWindowUpdate()
+	done := st.remoteClosed
+	st.Unlock()
+	st.notify()
+
+	err := st.session.writeFrame(muxTypeWindowUpdate, muxFlagFIN, st.id, 0, nil)
+	if done {
+		st.session.forget(st.id)
+	} else {
+		time.AfterFunc(muxStreamLinger, func() {
+			st.Lock()
+			linger := !st.remoteClosed && !st.wasReset
+			st.Unlock()
+			if linger {
+				st.session.writeFrame(muxTypeWindowUpdate, muxFlagRST, st.id, 0, nil)
+				st.session.forget(st.id)
+			}
+		})
+	}
+	return err
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.Lock()
+	st.readDeadline = t
+	st.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.Lock()
+	st.writeDeadline = t
+	st.Unlock()
+	st.notify()
+	return nil
+}
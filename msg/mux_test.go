@@ -0,0 +1,216 @@
+package msg
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (client, server *Session) {
+	c, s := net.Pipe()
+	client, server = NewSession(c, true, true), NewSession(s, false, true)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+// openPair opens a stream on from and accepts it on to.
+func openPair(t *testing.T, from, to *Session) (opened, accepted *Stream) {
+	opened, err := from.Open()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+	if accepted, err = to.Accept(); err != nil {
+		t.Fatal("accept:", err)
+	}
+	return
+}
+
+func TestMuxStreamData(t *testing.T) {
+	client, server := newSessionPair(t)
+	a, b := openPair(t, server, client)
+	want := bytes.Repeat([]byte("0123456789"), 3*muxInitialWindow/10)
+	go func() {
+		a.Write(want)
+		a.Close()
+	}()
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(want))
+	}
+
+	// the peer may still write to a half closed stream, the data is
+	// dropped but its window is given back
+	b.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err = b.Write(make([]byte, 2*muxInitialWindow)); err != nil {
+		t.Fatal("write to a half closed stream:", err)
+	}
+}
+
+func TestMuxStreamIds(t *testing.T) {
+	client, server := newSessionPair(t)
+	tests := []struct {
+		from, to *Session
+		id       uint32
+	}{
+		{client, server, 1},
+		{server, client, 2},
+		{client, server, 3},
+		{server, client, 4},
+	}
+	for _, tt := range tests {
+		opened, accepted := openPair(t, tt.from, tt.to)
+		if opened.id != tt.id || accepted.id != tt.id {
+			t.Fatalf("opened stream %d, accepted %d, want %d", opened.id, accepted.id, tt.id)
+		}
+	}
+	if client.NumStreams() != 4 || server.NumStreams() != 4 {
+		t.Fatalf("streams %d and %d, want 4", client.NumStreams(), server.NumStreams())
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := newSessionPair(t)
+	a, b := openPair(t, server, client)
+
+	// nothing reads b, so a can only send its window
+	a.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := a.Write(make([]byte, 2*muxInitialWindow))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write got %v, want a timeout", err)
+	}
+	if n != muxInitialWindow {
+		t.Fatalf("wrote %d bytes without a window update, want %d", n, muxInitialWindow)
+	}
+
+	// a full stream doesn't stall the others
+	c, d := openPair(t, server, client)
+	go c.Write([]byte("other"))
+	buf := make([]byte, 5)
+	d.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(d, buf); err != nil || string(buf) != "other" {
+		t.Fatalf("read %q, %v from the second stream", buf, err)
+	}
+
+	// reading b grants a window again
+	done := make(chan error, 1)
+	go func() {
+		a.SetWriteDeadline(time.Time{})
+		_, err := a.Write(make([]byte, muxInitialWindow))
+		done <- err
+	}()
+	if _, err = io.ReadFull(b, make([]byte, 2*muxInitialWindow)); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal("write after the window update:", err)
+	}
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	client, server := newSessionPair(t)
+	a, b := openPair(t, server, client)
+
+	a.Close()
+	if _, err := a.Write([]byte("x")); err != ErrStreamClosed {
+		t.Fatalf("write after close got %v, want %v", err, ErrStreamClosed)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the peer closed got %v, want EOF", err)
+	}
+	b.Close()
+
+	// both sides forget the stream once it is closed twice
+	deadline := time.Now().Add(time.Second)
+	for client.NumStreams()+server.NumStreams() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams left: %d and %d", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMuxStreamReset(t *testing.T) {
+	client, server := newSessionPair(t)
+	a, b := openPair(t, server, client)
+
+	server.writeFrame(muxTypeWindowUpdate, muxFlagRST, a.id, 0, nil)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := b.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("read after reset got %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("write after reset got %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestMuxRefuseStreams(t *testing.T) {
+	c, s := net.Pipe()
+	client, server := NewSession(c, true, true), NewSession(s, false, false)
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Write([]byte("ignored"))
+		st.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = st.Read(make([]byte, 1)); err != ErrStreamReset {
+			t.Fatalf("read from a refused stream got %v, want %v", err, ErrStreamReset)
+		}
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Fatalf("the refusing end kept %d streams", n)
+	}
+	if _, err := server.Accept(); err != errMuxNoAccept {
+		t.Fatalf("accept got %v, want %v", err, errMuxNoAccept)
+	}
+
+	// streams the refusing end opens work as usual
+	opened, accepted := openPair(t, server, client)
+	go opened.Write([]byte("ok"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	client, server := newSessionPair(t)
+	a, b := openPair(t, server, client)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := client.Accept()
+		accepted <- err
+	}()
+	server.Close()
+
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("the peer session didn't close")
+	}
+	if err := <-accepted; err != ErrSessionClosed {
+		t.Fatalf("accept got %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Fatalf("read got %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := a.Write([]byte("x")); err != ErrSessionClosed {
+		t.Fatalf("write got %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := server.Open(); err != ErrSessionClosed {
+		t.Fatalf("open got %v, want %v", err, ErrSessionClosed)
+	}
+}
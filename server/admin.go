@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func registerAdminApi(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/admin/controls/", adminHandler(controlAction, http.MethodPost))
+	mux.HandleFunc("/v1/admin/bans", adminHandler(banAction, http.MethodGet, http.MethodPost, http.MethodDelete))
+	// sessions name the accounts of proxy users and where they go
+	mux.HandleFunc("/v1/sessions", adminHandler(listSessions, http.MethodGet, http.MethodHead))
+}
+
+// adminHandler is apiMethods for requests which carry the admin token as
+// "Authorization: Bearer <token>".
+func adminHandler(f func(req *http.Request) (interface{}, error), methods ...string) http.HandlerFunc {
+	h := apiMethods(f, methods...)
+	return func(resp http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(opts.AdminToken)) != 1 {
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="dproxy"`)
+			renderApiError(resp, &apiError{http.StatusUnauthorized, "unauthorized", "admin token required"})
+			return
+		}
+		h(resp, req)
+	}
+}
+
+// listSessions serves GET /v1/sessions, the sticky sessions.
+func listSessions(req *http.Request) (interface{}, error) {
+	return map[string]interface{}{"data": sessionTable.Sessions()}, nil
+}
+
+// controlAction serves POST /v1/admin/controls/{clientId}/{action}:
+//
+//	kick     disconnect the client, it may reconnect
+//	drain    stop assigning new connections, running ones continue
+//	undrain  assign new connections again
+//	ban      ban the token of the client, or the identity of its HMAC
+//	         token, its certificate and its device id, and disconnect it;
+//	         the body may give a {"reason": ""}
+func controlAction(req *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/admin/controls/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, notFound("no such endpoint: %s", req.URL.Path)
+	}
+	id, action := parts[0], parts[1]
+	ctl := controlRegistry.Get(id)
+	if ctl == nil {
+		return nil, notFound("client %s is not connected", id)
+	}
+	switch action {
+	case "kick":
+		ctl.Kick("kicked by admin")
+	case "drain":
+		ctl.SetDraining(true)
+	case "undrain":
+		ctl.SetDraining(false)
+	case "ban":
+		var ban Ban
+		if err := decodeBody(req, &ban); err != nil {
+			return nil, err
+		}
+		ban = Ban{Reason: ban.Reason, CertName: tlsIdentity(ctl.conn), DeviceId: ctl.auth.DeviceId}
+		if ban.Identity = tokenIdentity(ctl.auth); ban.Identity == "" {
+			ban.Token = ctl.auth.Token
+		}
+		if ban.empty() {
+			return nil, badRequest("client %s has no credentials to ban", id)
+		}
+		if err := addBan(ban); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, notFound("unknown action %q", action)
+	}
+	log.Printf("admin %s client %s\n", action, id)
+	return map[string]interface{}{"data": newControlView(ctl)}, nil
+}
+
+// banAction serves /v1/admin/bans. GET lists the bans, POST adds the ban
+// in the body and disconnects the clients it matches, DELETE lifts the
+// bans of the token, identity, certName or deviceId query parameters.
+func banAction(req *http.Request) (interface{}, error) {
+	switch req.Method {
+	case http.MethodPost:
+		var ban Ban
+		if err := decodeBody(req, &ban); err != nil {
+			return nil, err
+		}
+		if err := addBan(ban); err != nil {
+			return nil, err
+		}
+	case http.MethodDelete:
+		q := req.URL.Query()
+		match := Ban{Token: q.Get("token"), Identity: q.Get("identity"), CertName: q.Get("certName"), DeviceId: q.Get("deviceId")}
+		if match.empty() {
+			return nil, badRequest("token, identity, certName or deviceId is required")
+		}
+		removed, err := banList.Remove(match)
+		if err != nil {
+			return nil, err
+		}
+		if !removed {
+			return nil, notFound("no such ban")
+		}
+		log.Printf("admin lifted bans of %s\n", match.describe())
+	}
+	return map[string]interface{}{"data": banList.Bans()}, nil
+}
+
+func addBan(ban Ban) error {
+	if ban.empty() {
+		return badRequest("a ban needs a token, identity, certName or deviceId")
+	}
+	if err := banList.Add(ban); err != nil {
+		return err
+	}
+	log.Printf("admin banned %s: %s\n", ban.describe(), ban.Reason)
+	controlRegistry.Foreach(func(ctl *Control) bool {
+		if ban.Matches(ctl.auth, tlsIdentity(ctl.conn)) {
+			ctl.Kick("banned")
+		}
+		return false
+	})
+	return nil
+}
+
+// decodeBody decodes the json body of req into v, an empty body leaves v
+// untouched.
+func decodeBody(req *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(v)
+	if err != nil && err != io.EOF {
+		return badRequest("invalid body: %v", err)
+	}
+	return nil
+}
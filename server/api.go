@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// apiError is the body of every failed /v1 response, wrapped in
+// {"error": ...}.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusBadRequest, "bad_request", fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusNotFound, "not_found", fmt.Sprintf(format, args...)}
+}
+
+// ControlView is the json representation of a control.
+type ControlView struct {
+	ClientId      string    `json:"clientId"`
+	CityCode      string    `json:"cityCode"`
+	ProtoVersion  string    `json:"protoVersion"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Lat           float64   `json:"lat"`
+	Lng           float64   `json:"lng"`
+	Weight        int       `json:"weight"`
+	Active        int64     `json:"active"`
+	Streams       int       `json:"streams"`
+	MaxStreams    int       `json:"maxStreams"`
+	RttMs         float64   `json:"rttMs"`
+	Sessions      int       `json:"sessions"`
+	Draining      bool      `json:"draining"`
+	DailyQuota    int64     `json:"dailyQuota"`
+	DailyUsed     int64     `json:"dailyUsed"`
+	MonthlyQuota  int64     `json:"monthlyQuota"`
+	MonthlyUsed   int64     `json:"monthlyUsed"`
+	OverQuota     bool      `json:"overQuota"`
+	PooledProxies int       `json:"pooledProxies"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	Uptime        float64   `json:"uptime"` // seconds
+}
+
+func newControlView(ctl *Control) *ControlView {
+	day, month := ctl.quota.Used()
+	streams, maxStreams := ctl.streams.used()
+	return &ControlView{
+		ClientId:      ctl.id,
+		CityCode:      ctl.auth.CityCode,
+		ProtoVersion:  ctl.auth.ProtoVersion,
+		RemoteAddr:    ctl.conn.RemoteAddr().String(),
+		Lat:           ctl.auth.GpsLat,
+		Lng:           ctl.auth.GpsLit,
+		Weight:        ctl.Weight(),
+		Active:        ctl.Active(),
+		Streams:       streams,
+		MaxStreams:    maxStreams,
+		RttMs:         float64(ctl.Rtt()) / 1000,
+		Sessions:      ctl.NumSessions(),
+		Draining:      ctl.Draining(),
+		DailyQuota:    ctl.auth.DailyQuota,
+		DailyUsed:     day,
+		MonthlyQuota:  ctl.auth.MonthlyQuota,
+		MonthlyUsed:   month,
+		OverQuota:     ctl.OverQuota(),
+		PooledProxies: len(ctl.proxies),
+		ConnectedAt:   ctl.created,
+		Uptime:        time.Since(ctl.created).Seconds(),
+	}
+}
+
+// apiHandler turns f into a GET handler which renders the data f returns,
+// or the error in the shape of apiError.
+func apiHandler(f func(req *http.Request) (interface{}, error)) http.HandlerFunc {
+	return apiMethods(f, http.MethodGet, http.MethodHead)
+}
+
+// apiMethods is apiHandler for the given request methods.
+func apiMethods(f func(req *http.Request) (interface{}, error), methods ...string) http.HandlerFunc {
+	allowed := strings.Join(methods, ", ")
+	return func(resp http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("api %s failed with error %v: %s\n", req.URL, r, debug.Stack())
+				renderApiError(resp, &apiError{http.StatusInternalServerError, "internal", "internal server error"})
+			}
+		}()
+		if !containsString(methods, req.Method) {
+			resp.Header().Set("Allow", allowed)
+			renderApiError(resp, &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed"})
+			return
+		}
+		data, err := f(req)
+		if err != nil {
+			renderApiError(resp, err)
+			return
+		}
+		renderJson(&resp, http.StatusOK, data)
+	}
+}
+
+func renderApiError(resp http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = &apiError{http.StatusInternalServerError, "internal", err.Error()}
+	}
+	renderJson(&resp, e.Status, map[string]interface{}{"error": e})
+}
+
+func registerApi(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/controls", apiHandler(listControls))
+	mux.HandleFunc("/v1/controls/", apiHandler(getControl))
+	mux.HandleFunc("/v1/nearest", apiHandler(nearestControls))
+	if opts.AdminToken != "" {
+		registerAdminApi(mux)
+	}
+	mux.HandleFunc("/v1/", apiHandler(func(req *http.Request) (interface{}, error) {
+		return nil, notFound("no such endpoint: %s", req.URL.Path)
+	}))
+}
+
+// listControls serves GET /v1/controls. The controls are ordered by client
+// id and filtered by the query parameters
+//
+//	city          city code
+//	version       protocol version
+//	minUptime     connected at least this long, e.g. 10m
+//	maxUptime     connected at most this long
+//	page          1 based page number
+//	pageSize      controls per page, at most 500
+func listControls(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	city, version := query.Get("city"), query.Get("version")
+	minUptime, err := durationParam(query.Get("minUptime"))
+	if err != nil {
+		return nil, badRequest("invalid minUptime: %v", err)
+	}
+	maxUptime, err := durationParam(query.Get("maxUptime"))
+	if err != nil {
+		return nil, badRequest("invalid maxUptime: %v", err)
+	}
+	page, err := intParam(query.Get("page"), 1)
+	if err != nil || page < 1 {
+		return nil, badRequest("page must be a positive integer")
+	}
+	pageSize, err := intParam(query.Get("pageSize"), defaultPageSize)
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		return nil, badRequest("pageSize must be between 1 and %d", maxPageSize)
+	}
+
+	now := time.Now()
+	controls := controlRegistry.Filter(func(ctl *Control) bool {
+		uptime := now.Sub(ctl.created)
+		return (city == "" || ctl.auth.CityCode == city) &&
+			(version == "" || ctl.auth.ProtoVersion == version) &&
+			(minUptime == 0 || uptime >= minUptime) &&
+			(maxUptime == 0 || uptime <= maxUptime)
+	})
+	total := len(controls)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	data := make([]*ControlView, 0, end-start)
+	for _, ctl := range controls[start:end] {
+		data = append(data, newControlView(ctl))
+	}
+	return map[string]interface{}{
+		"data":     data,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	}, nil
+}
+
+// getControl serves GET /v1/controls/{clientId}.
+func getControl(req *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/controls/")
+	if id == "" || strings.Contains(id, "/") {
+		return nil, notFound("no such endpoint: %s", req.URL.Path)
+	}
+	ctl := controlRegistry.Get(id)
+	if ctl == nil {
+		return nil, notFound("client %s is not connected", id)
+	}
+	return map[string]interface{}{"data": newControlView(ctl)}, nil
+}
+
+// GeoView is a control found by a geo query.
+type GeoView struct {
+	*ControlView
+	Distance float64 `json:"distance"` // km
+}
+
+// nearestControls serves GET /v1/nearest?lat=&lng=, the controls nearest to
+// a position. With radius (km) it returns all controls within the radius,
+// otherwise the nearest limit ones. city restricts them to a city code.
+func nearestControls(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	lng, errLng := strconv.ParseFloat(query.Get("lng"), 64)
+	if errLat != nil || errLng != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, badRequest("lat and lng are required and must be within range")
+	}
+	limit, err := intParam(query.Get("limit"), 0)
+	if err != nil || limit < 0 || limit > maxPageSize {
+		return nil, badRequest("limit must be between 1 and %d", maxPageSize)
+	}
+	radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+	if query.Get("radius") != "" && (err != nil || radius <= 0) {
+		return nil, badRequest("radius must be a positive number")
+	}
+	city := query.Get("city")
+	inCity := func(ctl *Control) bool {
+		return city == "" || ctl.auth.CityCode == city
+	}
+
+	var matches []GeoMatch
+	if radius > 0 {
+		matches = controlRegistry.Within(lat, lng, radius, inCity)
+		if limit > 0 && len(matches) > limit {
+			matches = matches[:limit]
+		}
+	} else {
+		if limit == 0 {
+			limit = 1
+		}
+		matches = controlRegistry.Nearest(lat, lng, limit, inCity)
+	}
+	data := make([]GeoView, 0, len(matches))
+	for _, m := range matches {
+		data = append(data, GeoView{newControlView(m.Control), m.Distance})
+	}
+	return map[string]interface{}{"data": data}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func durationParam(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	// plain numbers are seconds
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(n * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
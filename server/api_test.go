@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newApiMux registers the api over controls a01 to a12, a01 the oldest, of
+// city 110000 and then 310000 every third one, speaking version 3 but a12.
+func newApiMux(t *testing.T) *http.ServeMux {
+	opts = defaultConfig()
+	opts.AdminToken = "admin"
+	controlRegistry = NewControlRegistry()
+	sessionTable = NewSessionTable(time.Minute)
+	conn, other := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	for i := 1; i <= 12; i++ {
+		city := "110000"
+		if i%3 == 0 {
+			city = "310000"
+		}
+		ctl := newTestControl(fmt.Sprintf("a%02d", i), city, 30+float64(i)/10, 120)
+		ctl.auth.ProtoVersion = "3"
+		if i == 12 {
+			ctl.auth.ProtoVersion = "2"
+		}
+		ctl.conn = conn
+		ctl.created = time.Now().Add(-time.Duration(13-i) * time.Hour)
+		controlRegistry.Add(ctl.id, ctl)
+	}
+	mux := http.NewServeMux()
+	registerApi(mux)
+	return mux
+}
+
+type apiResponse struct {
+	Data []struct {
+		ClientId string  `json:"clientId"`
+		Distance float64 `json:"distance"`
+	} `json:"data"`
+	Total    int       `json:"total"`
+	Page     int       `json:"page"`
+	PageSize int       `json:"pageSize"`
+	Error    *apiError `json:"error"`
+}
+
+func getApi(t *testing.T, mux *http.ServeMux, path, token string) (int, *apiResponse) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	resp := new(apiResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+		t.Fatalf("GET %s: invalid body %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func ids(from, to, step int) []string {
+	var ids []string
+	for i := from; i <= to; i += step {
+		ids = append(ids, fmt.Sprintf("a%02d", i))
+	}
+	return ids
+}
+
+func TestListControls(t *testing.T) {
+	mux := newApiMux(t)
+	tests := []struct {
+		path   string
+		status int
+		ids    []string
+		total  int
+	}{
+		{"/v1/controls", 200, ids(1, 12, 1), 12},
+		{"/v1/controls?pageSize=5", 200, ids(1, 5, 1), 12},
+		{"/v1/controls?pageSize=5&page=3", 200, ids(11, 12, 1), 12},
+		{"/v1/controls?pageSize=5&page=4", 200, nil, 12},
+		{"/v1/controls?city=310000", 200, ids(3, 12, 3), 4},
+		{"/v1/controls?city=310000&pageSize=3&page=2", 200, ids(12, 12, 1), 4},
+		{"/v1/controls?city=440100", 200, nil, 0},
+		{"/v1/controls?version=2", 200, ids(12, 12, 1), 1},
+		{"/v1/controls?minUptime=10h", 200, ids(1, 3, 1), 3},
+		{"/v1/controls?maxUptime=90m", 200, ids(12, 12, 1), 1},
+		{"/v1/controls?minUptime=7200&maxUptime=4h30m&city=110000", 200, ids(10, 11, 1), 2},
+		{"/v1/controls?page=0", 400, nil, 0},
+		{"/v1/controls?page=x", 400, nil, 0},
+		{"/v1/controls?pageSize=501", 400, nil, 0},
+		{"/v1/controls?minUptime=soon", 400, nil, 0},
+		{"/v1/controls/zz", 404, nil, 0},
+		{"/v1/controls/a05/x", 404, nil, 0},
+		{"/v1/unknown", 404, nil, 0},
+	}
+	for _, tt := range tests {
+		status, resp := getApi(t, mux, tt.path, "")
+		if status != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, status, tt.status)
+			continue
+		}
+		if status != 200 {
+			if resp.Error == nil || resp.Error.Status != status {
+				t.Errorf("GET %s: error %+v", tt.path, resp.Error)
+			}
+			continue
+		}
+		if tt.ids == nil && tt.total == 0 {
+			continue
+		}
+		var got []string
+		for _, d := range resp.Data {
+			got = append(got, d.ClientId)
+		}
+		if !reflect.DeepEqual(got, tt.ids) || resp.Total != tt.total {
+			t.Errorf("GET %s: %v of %d, want %v of %d", tt.path, got, resp.Total, tt.ids, tt.total)
+		}
+	}
+}
+
+func TestGetControl(t *testing.T) {
+	mux := newApiMux(t)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/controls/a03", nil))
+	var resp struct {
+		Data *ControlView `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Data == nil {
+		t.Fatalf("invalid body %q: %v", rec.Body.String(), err)
+	}
+	if v := resp.Data; v.ClientId != "a03" || v.CityCode != "310000" || v.Lat != 30.3 || v.Uptime < 10*3600 {
+		t.Errorf("got %+v", v)
+	}
+}
+
+func TestNearestControls(t *testing.T) {
+	mux := newApiMux(t)
+	tests := []struct {
+		path   string
+		status int
+		ids    []string
+	}{
+		{"/v1/nearest?lat=30.5&lng=120", 200, ids(5, 5, 1)},
+		{"/v1/nearest?lat=30.5&lng=120&limit=3", 200, []string{"a05", "a04", "a06"}},
+		{"/v1/nearest?lat=30.5&lng=120&limit=2&city=310000", 200, []string{"a06", "a03"}},
+		{"/v1/nearest?lat=30.5&lng=120&radius=15", 200, []string{"a05", "a04", "a06"}},
+		{"/v1/nearest?lat=30.5&lng=120&radius=50&limit=1", 200, ids(5, 5, 1)},
+		{"/v1/nearest?lat=0&lng=0&radius=10", 200, nil},
+		{"/v1/nearest?lat=30.5", 400, nil},
+		{"/v1/nearest?lat=91&lng=0", 400, nil},
+		{"/v1/nearest?lat=30&lng=120&radius=-1", 400, nil},
+		{"/v1/nearest?lat=30&lng=120&limit=501", 400, nil},
+	}
+	for _, tt := range tests {
+		status, resp := getApi(t, mux, tt.path, "")
+		if status != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, status, tt.status)
+			continue
+		}
+		var got []string
+		for _, d := range resp.Data {
+			got = append(got, d.ClientId)
+		}
+		if !reflect.DeepEqual(got, tt.ids) {
+			t.Errorf("GET %s: %v, want %v", tt.path, got, tt.ids)
+		}
+	}
+}
+
+func TestSessionsNeedAdminToken(t *testing.T) {
+	mux := newApiMux(t)
+	for _, tt := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"admin", http.StatusOK},
+	} {
+		if status, _ := getApi(t, mux, "/v1/sessions", tt.token); status != tt.status {
+			t.Errorf("GET /v1/sessions with token %q: status %d, want %d", tt.token, status, tt.status)
+		}
+	}
+
+	// without an admin token there is no such endpoint
+	opts.AdminToken = ""
+	mux = http.NewServeMux()
+	registerApi(mux)
+	if status, _ := getApi(t, mux, "/v1/sessions", ""); status != http.StatusNotFound {
+		t.Errorf("GET /v1/sessions without admin api: status %d", status)
+	}
+}
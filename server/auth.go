@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/snaigle/dproxy/msg"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errAuthToken   = errors.New("invalid auth token")
+	errAuthExpired = errors.New("auth token expired")
+)
+
+// Authenticator decides whether a client may open a control connection.
+// A non-nil error rejects the client; its text is sent back to the client
+// in AuthResp.Error before the connection is closed.
+type Authenticator interface {
+	Authenticate(auth *msg.Auth) error
+}
+
+// Identifier is implemented by authenticators whose tokens name who they
+// were issued to. Identity returns the empty string for tokens it didn't
+// issue.
+type Identifier interface {
+	Identity(auth *msg.Auth) string
+}
+
+// MultiAuthenticator accepts a client if any of its authenticators does,
+// otherwise it returns the first rejection.
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) Authenticate(auth *msg.Auth) (err error) {
+	for _, a := range m {
+		e := a.Authenticate(auth)
+		if e == nil {
+			return nil
+		}
+		if err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Identity returns the identity of the first authenticator that knows one.
+func (m MultiAuthenticator) Identity(auth *msg.Auth) string {
+	for _, a := range m {
+		if i, ok := a.(Identifier); ok {
+			if identity := i.Identity(auth); identity != "" {
+				return identity
+			}
+		}
+	}
+	return ""
+}
+
+// TokenFileAuthenticator accepts the tokens listed in a file, one per line.
+// Blank lines and lines starting with # are ignored. The file is reloaded
+// when its modification time changes.
+type TokenFileAuthenticator struct {
+	path    string
+	modTime time.Time
+	tokens  map[string]bool
+	sync.RWMutex
+}
+
+func NewTokenFileAuthenticator(path string) (*TokenFileAuthenticator, error) {
+	a := &TokenFileAuthenticator{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *TokenFileAuthenticator) reload() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	a.RLock()
+	unchanged := fi.ModTime().Equal(a.modTime)
+	a.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tokens := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens[line] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.tokens = tokens
+	a.modTime = fi.ModTime()
+	a.Unlock()
+	log.Printf("loaded %d tokens from %s\n", len(tokens), a.path)
+	return nil
+}
+
+func (a *TokenFileAuthenticator) Authenticate(auth *msg.Auth) error {
+	if err := a.reload(); err != nil {
+		// keep serving with the tokens we already have
+		log.Println("failed to reload token file:", err)
+	}
+	a.RLock()
+	defer a.RUnlock()
+	if !a.tokens[auth.Token] {
+		return errAuthToken
+	}
+	return nil
+}
+
+// HMACAuthenticator accepts tokens of the form identity:expiry:signature,
+// where expiry is a unix timestamp and signature is the hex encoded
+// HMAC-SHA256 of "identity:expiry" under a shared secret.
+type HMACAuthenticator struct {
+	secret []byte
+}
+
+func NewHMACAuthenticator(secret string) *HMACAuthenticator {
+	return &HMACAuthenticator{secret: []byte(secret)}
+}
+
+func (a *HMACAuthenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns a signed token for identity which expires at expiry.
+func (a *HMACAuthenticator) Token(identity string, expiry time.Time) string {
+	payload := identity + ":" + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + ":" + a.sign(payload)
+}
+
+// Identity returns the identity a validly signed token was issued to,
+// expired or not.
+func (a *HMACAuthenticator) Identity(auth *msg.Auth) string {
+	idx := strings.LastIndex(auth.Token, ":")
+	if idx < 0 {
+		return ""
+	}
+	payload, sig := auth.Token[:idx], auth.Token[idx+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.sign(payload))) {
+		return ""
+	}
+	if idx = strings.LastIndex(payload, ":"); idx < 0 {
+		return ""
+	}
+	return payload[:idx]
+}
+
+func (a *HMACAuthenticator) Authenticate(auth *msg.Auth) error {
+	idx := strings.LastIndex(auth.Token, ":")
+	if idx < 0 {
+		return errAuthToken
+	}
+	payload, sig := auth.Token[:idx], auth.Token[idx+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.sign(payload))) {
+		return errAuthToken
+	}
+	idx = strings.LastIndex(payload, ":")
+	if idx < 0 {
+		return errAuthToken
+	}
+	expiry, err := strconv.ParseInt(payload[idx+1:], 10, 64)
+	if err != nil {
+		return errAuthToken
+	}
+	if time.Now().Unix() > expiry {
+		return errAuthExpired
+	}
+	return nil
+}
+
+// authenticate checks the protocol version and required fields of an Auth
+// message read from conn, then hands it to the configured authenticator.
+func authenticate(conn net.Conn, auth *msg.Auth) error {
+	if auth.ProtoVersion != msg.Version {
+		return fmt.Errorf("incompatible protocol version %q, server speaks %q", auth.ProtoVersion, msg.Version)
+	}
+	if auth.CityCode == "" {
+		return errors.New("cityCode couldn't be empty")
+	}
+	if err := banList.Check(auth, tlsIdentity(conn)); err != nil {
+		return err
+	}
+	if authenticator == nil {
+		return nil
+	}
+	return authenticator.Authenticate(auth)
+}
+
+// clientIdentity returns who the client on conn authenticated as: the
+// common name of its verified certificate, the identity of its HMAC token
+// or else its token. Unlike the device id these are credentials the client
+// can't make up. It is the empty string for clients without a token when
+// no authenticator is configured.
+func clientIdentity(conn net.Conn, auth *msg.Auth) string {
+	if cn := tlsIdentity(conn); cn != "" {
+		return "cert:" + cn
+	}
+	if identity := tokenIdentity(auth); identity != "" {
+		return "hmac:" + identity
+	}
+	if auth.Token != "" {
+		return "token:" + auth.Token
+	}
+	return ""
+}
+
+// tokenIdentity returns the identity the token of auth was issued to, the
+// empty string for tokens without one.
+func tokenIdentity(auth *msg.Auth) string {
+	if i, ok := authenticator.(Identifier); ok {
+		return i.Identity(auth)
+	}
+	return ""
+}
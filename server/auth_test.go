@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/msg"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	a := NewHMACAuthenticator("secret")
+	other := NewHMACAuthenticator("other")
+	valid := a.Token("node-1", time.Now().Add(time.Hour))
+	expired := a.Token("node-1", time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		token    string
+		err      error
+		identity string
+	}{
+		{valid, nil, "node-1"},
+		{a.Token("team:node-2", time.Now().Add(time.Hour)), nil, "team:node-2"},
+		{expired, errAuthExpired, "node-1"},
+		{other.Token("node-1", time.Now().Add(time.Hour)), errAuthToken, ""},
+		{valid[:len(valid)-1] + "0", errAuthToken, ""},
+		{"node-1:9999999999:" + a.sign("node-2:9999999999"), errAuthToken, ""},
+		{"node-1:soon:" + a.sign("node-1:soon"), errAuthToken, "node-1"},
+		{a.sign("node-1") + ":" + a.sign(a.sign("node-1")), errAuthToken, ""},
+		{"", errAuthToken, ""},
+		{"plain-token", errAuthToken, ""},
+	}
+	for _, tt := range tests {
+		auth := &msg.Auth{Token: tt.token}
+		if err := a.Authenticate(auth); err != tt.err {
+			t.Errorf("Authenticate(%q) = %v, want %v", tt.token, err, tt.err)
+		}
+		if identity := a.Identity(auth); identity != tt.identity {
+			t.Errorf("Identity(%q) = %q, want %q", tt.token, identity, tt.identity)
+		}
+	}
+}
+
+func TestMultiAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte("# exit nodes\nplain-token\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacAuth := NewHMACAuthenticator("secret")
+	m := MultiAuthenticator{tokens, hmacAuth}
+
+	tests := []struct {
+		token    string
+		err      error
+		identity string
+	}{
+		{"plain-token", nil, ""},
+		{hmacAuth.Token("node-1", time.Now().Add(time.Hour)), nil, "node-1"},
+		// the first rejection is returned
+		{hmacAuth.Token("node-1", time.Now().Add(-time.Hour)), errAuthToken, "node-1"},
+		{"# exit nodes", errAuthToken, ""},
+		{"", errAuthToken, ""},
+	}
+	for _, tt := range tests {
+		auth := &msg.Auth{Token: tt.token}
+		if err := m.Authenticate(auth); err != tt.err {
+			t.Errorf("Authenticate(%q) = %v, want %v", tt.token, err, tt.err)
+		}
+		if identity := m.Identity(auth); identity != tt.identity {
+			t.Errorf("Identity(%q) = %q, want %q", tt.token, identity, tt.identity)
+		}
+	}
+
+	expired := &msg.Auth{Token: hmacAuth.Token("node-1", time.Now().Add(-time.Hour))}
+	if err = (MultiAuthenticator{hmacAuth, tokens}).Authenticate(expired); err != errAuthExpired {
+		t.Errorf("rejected with %v, want %v", err, errAuthExpired)
+	}
+}
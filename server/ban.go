@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/snaigle/dproxy/msg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban rejects the clients authenticating with any of the credentials that
+// are set: a token, the identity of HMAC tokens, which outlives the tokens
+// issued to it, the common name of a client certificate or a device id.
+// Clients make their device ids up, so those only hold off a client that
+// doesn't know to change it.
+type Ban struct {
+	Token    string    `json:"token,omitempty"`
+	Identity string    `json:"identity,omitempty"`
+	CertName string    `json:"certName,omitempty"`
+	DeviceId string    `json:"deviceId,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// Matches reports whether the ban rejects a client authenticating with
+// auth and a certificate with the common name certName.
+func (b *Ban) Matches(auth *msg.Auth, certName string) bool {
+	return b.Token != "" && b.Token == auth.Token ||
+		b.Identity != "" && b.Identity == tokenIdentity(auth) ||
+		b.CertName != "" && b.CertName == certName ||
+		b.DeviceId != "" && b.DeviceId == auth.DeviceId
+}
+
+// describe lists the values of the ban for the log, tokens are secrets
+// and only named.
+func (b *Ban) describe() string {
+	var parts []string
+	if b.Token != "" {
+		parts = append(parts, "a token")
+	}
+	if b.Identity != "" {
+		parts = append(parts, fmt.Sprintf("identity %q", b.Identity))
+	}
+	if b.CertName != "" {
+		parts = append(parts, fmt.Sprintf("certificate %q", b.CertName))
+	}
+	if b.DeviceId != "" {
+		parts = append(parts, fmt.Sprintf("device %q", b.DeviceId))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (b *Ban) empty() bool {
+	return b.Token == "" && b.Identity == "" && b.CertName == "" && b.DeviceId == ""
+}
+
+// names reports whether the ban has any of the values set in other.
+func (b *Ban) names(other *Ban) bool {
+	return other.Token != "" && b.Token == other.Token ||
+		other.Identity != "" && b.Identity == other.Identity ||
+		other.CertName != "" && b.CertName == other.CertName ||
+		other.DeviceId != "" && b.DeviceId == other.DeviceId
+}
+
+// BanList holds the bans and writes them to path on every change, so they
+// survive restarts. An empty path keeps them in memory only.
+type BanList struct {
+	path string
+	bans []Ban
+	sync.RWMutex
+}
+
+func LoadBanList(path string) (*BanList, error) {
+	l := &BanList{path: path}
+	if path == "" {
+		return l, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &l.bans); err != nil {
+		return nil, fmt.Errorf("invalid ban file %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// Check returns an error if the client authenticating with auth and a
+// certificate with the common name certName is banned.
+func (l *BanList) Check(auth *msg.Auth, certName string) error {
+	l.RLock()
+	defer l.RUnlock()
+	for i := range l.bans {
+		if l.bans[i].Matches(auth, certName) {
+			return errors.New("client is banned")
+		}
+	}
+	return nil
+}
+
+func (l *BanList) Bans() []Ban {
+	l.RLock()
+	defer l.RUnlock()
+	bans := make([]Ban, len(l.bans))
+	copy(bans, l.bans)
+	return bans
+}
+
+// Add adds ban unless an equal one exists.
+func (l *BanList) Add(ban Ban) error {
+	if ban.empty() {
+		return errors.New("a ban needs a token, identity, certName or deviceId")
+	}
+	l.Lock()
+	defer l.Unlock()
+	for _, b := range l.bans {
+		if b.Token == ban.Token && b.Identity == ban.Identity && b.CertName == ban.CertName && b.DeviceId == ban.DeviceId {
+			return nil
+		}
+	}
+	ban.Created = time.Now()
+	l.bans = append(l.bans, ban)
+	return l.save()
+}
+
+// Remove lifts the bans naming any of the values set in match and reports
+// whether there were any.
+func (l *BanList) Remove(match Ban) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	bans := l.bans[:0]
+	for _, b := range l.bans {
+		if b.names(&match) {
+			continue
+		}
+		bans = append(bans, b)
+	}
+	removed := len(bans) < len(l.bans)
+	l.bans = bans
+	if !removed {
+		return false, nil
+	}
+	return true, l.save()
+}
+
+// save writes the bans to a temporary file first so a crash doesn't leave
+// a truncated ban file behind.
+func (l *BanList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(l.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
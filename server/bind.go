@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/msg"
+	"log"
+	"net"
+)
+
+// handleBind serves a SOCKS5 BIND request. The exit client listens in its
+// own network; the first reply carries its listening address and the
+// second one, sent once the inbound connection arrives, its peer address.
+// The inbound connection is then relayed to the socks client if the policy
+// allows its peer like a target.
+func handleBind(conn net.Conn, route *Route, ctl *Control, addr string, u *UsageRecord) {
+	proxy, err := startProxyConn(ctl, &msg.StartBind{ClientAddr: addr})
+	if err != nil {
+		log.Println("failed get proxy connection:", err)
+		socksFailed.Inc(socksFailNoProxy)
+		writeSocksReply(conn, socksRepGeneralFailure, "")
+		return
+	}
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		var result msg.BindResult
+		if err = msg.ReadMsgInto(proxy, &result); err != nil {
+			log.Println("failed to read bind result:", err)
+			writeSocksReply(conn, socksRepGeneralFailure, "")
+			return
+		}
+		if result.Error != "" {
+			log.Println("bind failed:", result.Error)
+			writeSocksReply(conn, socksRepGeneralFailure, "")
+			return
+		}
+		if i == 1 && !allowDest(u.User, route, ctl, result.Addr) {
+			log.Printf("rejected bind of user %q from %s: %v\n", u.User, result.Addr, errDestNotAllowed)
+			socksFailed.Inc(socksFailNotAllowed)
+			writeSocksReply(conn, socksRepNotAllowed, "")
+			return
+		}
+		if err = writeSocksReply(conn, socksRepSucceeded, result.Addr); err != nil {
+			log.Println("send bind reply:", err)
+			return
+		}
+		if i == 0 {
+			log.Println("bind listening on", result.Addr)
+		} else {
+			log.Println("bind accepted from", result.Addr)
+		}
+	}
+
+	relay(conn, proxy, u)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/snaigle/dproxy/util"
+	"net"
+	"os"
+	"time"
+)
+
+// Config holds the server settings. They are read from, in increasing
+// order of precedence, the defaults below, the file given by -config,
+// DPROXY_* environment variables and command line flags.
+type Config struct {
+	TunnelAddr string `json:"tunnelAddr" env:"DPROXY_TUNNEL_ADDR"`
+	SocksAddr  string `json:"socksAddr" env:"DPROXY_SOCKS_ADDR"`
+	HttpAddr   string `json:"httpAddr" env:"DPROXY_HTTP_ADDR"`
+
+	// listen address of the http proxy, empty disables it
+	HttpProxyAddr string `json:"httpProxyAddr" env:"DPROXY_HTTP_PROXY_ADDR"`
+
+	// heartbeats and timeouts of control and proxy connections
+	PingTimeout        util.Duration `json:"pingTimeout" env:"DPROXY_PING_TIMEOUT"`
+	ReapInterval       util.Duration `json:"reapInterval" env:"DPROXY_REAP_INTERVAL"`
+	WriteTimeout       util.Duration `json:"writeTimeout" env:"DPROXY_WRITE_TIMEOUT"`
+	ReadTimeout        util.Duration `json:"readTimeout" env:"DPROXY_READ_TIMEOUT"`
+	ProxyStaleDuration util.Duration `json:"proxyStaleDuration" env:"DPROXY_PROXY_STALE_DURATION"`
+	ProxyMaxPoolSize   int           `json:"proxyMaxPoolSize" env:"DPROXY_PROXY_MAX_POOL_SIZE"`
+	DialTimeout        util.Duration `json:"dialTimeout" env:"DPROXY_DIAL_TIMEOUT"`
+
+	// how long the http proxy waits for request headers and keeps idle
+	// keep-alive connections
+	HttpHeaderTimeout util.Duration `json:"httpHeaderTimeout" env:"DPROXY_HTTP_HEADER_TIMEOUT"`
+	HttpIdleTimeout   util.Duration `json:"httpIdleTimeout" env:"DPROXY_HTTP_IDLE_TIMEOUT"`
+
+	// how connections are spread over the clients of a city, one of
+	// round-robin, least-active, weighted-random and lowest-rtt
+	Balance string `json:"balance" env:"DPROXY_BALANCE"`
+
+	// how long an idle sticky session keeps its client
+	SessionTTL util.Duration `json:"sessionTTL" env:"DPROXY_SESSION_TTL"`
+
+	// client authentication
+	AuthTokenFile  string `json:"authTokenFile" env:"DPROXY_AUTH_TOKEN_FILE"`
+	AuthHMACSecret string `json:"authHmacSecret" env:"DPROXY_AUTH_HMAC_SECRET" secret:"true"`
+
+	// json file of the socks5 and http proxy users, reloaded when it
+	// changes; empty accepts any credentials
+	UserFile string `json:"userFile" env:"DPROXY_USER_FILE"`
+
+	// json file of rules allowing or denying destinations by user and
+	// city, reloaded when it changes; empty allows all
+	PolicyFile string `json:"policyFile" env:"DPROXY_POLICY_FILE"`
+
+	// bearer token of the /v1/admin api, empty disables it
+	AdminToken string `json:"adminToken" env:"DPROXY_ADMIN_TOKEN" secret:"true"`
+
+	// where banned clients are kept, empty keeps them in memory
+	BanFile string `json:"banFile" env:"DPROXY_BAN_FILE"`
+
+	// usage records of relayed connections, written as json lines to a
+	// file rotated at a size in MB, 0 never rotates, and/or posted to a
+	// webhook. Records the webhook can't take are kept in the spool file
+	// until it does.
+	UsageFile           string `json:"usageFile" env:"DPROXY_USAGE_FILE"`
+	UsageFileMaxSize    int    `json:"usageFileMaxSize" env:"DPROXY_USAGE_FILE_MAX_SIZE"`
+	UsageFileMaxBackups int    `json:"usageFileMaxBackups" env:"DPROXY_USAGE_FILE_MAX_BACKUPS"`
+	UsageWebhook        string `json:"usageWebhook" env:"DPROXY_USAGE_WEBHOOK"`
+	UsageWebhookSpool   string `json:"usageWebhookSpool" env:"DPROXY_USAGE_WEBHOOK_SPOOL"`
+
+	// bandwidth limits in bytes per second, e.g. "1MB", of all relayed
+	// traffic, of each proxy user and of each exit client; 0 is unlimited.
+	// The maps, only read from the config file, override the user and
+	// client limits by account name or username and by client id.
+	RateLimit        util.ByteSize            `json:"rateLimit" env:"DPROXY_RATE_LIMIT"`
+	UserRateLimit    util.ByteSize            `json:"userRateLimit" env:"DPROXY_USER_RATE_LIMIT"`
+	ClientRateLimit  util.ByteSize            `json:"clientRateLimit" env:"DPROXY_CLIENT_RATE_LIMIT"`
+	UserRateLimits   map[string]util.ByteSize `json:"userRateLimits,omitempty"`
+	ClientRateLimits map[string]util.ByteSize `json:"clientRateLimits,omitempty"`
+
+	// concurrent connections of all proxy users and of each one, 0 is
+	// unlimited; userConnLimits overrides the user limit like
+	// userRateLimits. Connections beyond a limit, including the one each
+	// client announces, wait up to connQueueTimeout for a free slot, 0
+	// rejects them right away.
+	ConnLimit        int            `json:"connLimit" env:"DPROXY_CONN_LIMIT"`
+	UserConnLimit    int            `json:"userConnLimit" env:"DPROXY_USER_CONN_LIMIT"`
+	UserConnLimits   map[string]int `json:"userConnLimits,omitempty"`
+	ConnQueueTimeout util.Duration  `json:"connQueueTimeout" env:"DPROXY_CONN_QUEUE_TIMEOUT"`
+
+	// where the traffic of clients against their quotas is kept, empty
+	// keeps it in memory
+	QuotaFile string `json:"quotaFile" env:"DPROXY_QUOTA_FILE"`
+
+	// tls of the tunnel listener
+	TLSCert     string `json:"tlsCert" env:"DPROXY_TLS_CERT"`
+	TLSKey      string `json:"tlsKey" env:"DPROXY_TLS_KEY"`
+	TLSClientCA string `json:"tlsClientCA" env:"DPROXY_TLS_CLIENT_CA"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		TunnelAddr:         "127.0.0.1:1091",
+		SocksAddr:          "127.0.0.1:1090",
+		HttpAddr:           "127.0.0.1:9090",
+		HttpProxyAddr:      "127.0.0.1:1092",
+		PingTimeout:        util.Duration(30 * time.Second),
+		ReapInterval:       util.Duration(10 * time.Second),
+		WriteTimeout:       util.Duration(10 * time.Second),
+		ReadTimeout:        util.Duration(10 * time.Second),
+		ProxyStaleDuration: util.Duration(60 * time.Second),
+		ProxyMaxPoolSize:   10,
+		DialTimeout:        util.Duration(30 * time.Second),
+		HttpHeaderTimeout:  util.Duration(10 * time.Second),
+		HttpIdleTimeout:    util.Duration(60 * time.Second),
+		SessionTTL:         util.Duration(30 * time.Minute),
+		Balance:            BalanceRoundRobin,
+		BanFile:            ".dproxy-bans.json",
+		QuotaFile:          ".dproxy-quotas.json",
+		UsageWebhookSpool:  ".dproxy-usage-spool.jsonl",
+	}
+}
+
+// commandFlags are the command line flags that aren't part of the config.
+type commandFlags struct {
+	configFile  string
+	printConfig bool
+	genToken    string
+	genTokenTTL time.Duration
+	hashPass    string
+}
+
+func (c *Config) flagSet(cmd *commandFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&cmd.configFile, "config", "", "config file (.json, .yaml or .toml)")
+	fs.BoolVar(&cmd.printConfig, "print-config", false, "print the effective config and exit")
+	fs.StringVar(&cmd.genToken, "gen-token", "", "print a HMAC signed token for this identity and exit")
+	fs.DurationVar(&cmd.genTokenTTL, "gen-token-ttl", 30*24*time.Hour, "lifetime of the token printed by -gen-token")
+	fs.StringVar(&cmd.hashPass, "hash-password", "", "print the bcrypt hash of this password for the user file and exit")
+
+	fs.StringVar(&c.TunnelAddr, "tunnel-addr", c.TunnelAddr, "listen address for client control and proxy connections")
+	fs.StringVar(&c.SocksAddr, "socks-addr", c.SocksAddr, "listen address for socks5 connections")
+	fs.StringVar(&c.HttpAddr, "http-addr", c.HttpAddr, "listen address of the http api")
+	fs.StringVar(&c.HttpProxyAddr, "http-proxy-addr", c.HttpProxyAddr, "listen address for http proxy connections, empty disables it")
+	fs.Var(&c.PingTimeout, "ping-timeout", "close a control when no ping arrives within this time")
+	fs.Var(&c.ReapInterval, "reap-interval", "how often controls are checked for lost heartbeats")
+	fs.Var(&c.WriteTimeout, "write-timeout", "timeout for writing a control message")
+	fs.Var(&c.ReadTimeout, "read-timeout", "timeout for reading the first message of a tunnel connection")
+	fs.Var(&c.ProxyStaleDuration, "proxy-stale-duration", "how long a pooled proxy connection is kept")
+	fs.Var(&c.DialTimeout, "dial-timeout", "how long to wait for a client to connect to the target")
+	fs.Var(&c.HttpHeaderTimeout, "http-header-timeout", "timeout for reading the request headers of a http proxy connection")
+	fs.Var(&c.HttpIdleTimeout, "http-idle-timeout", "how long an idle http proxy connection is kept open")
+	fs.StringVar(&c.Balance, "balance", c.Balance, "load balancing strategy: round-robin, least-active, weighted-random or lowest-rtt")
+	fs.Var(&c.SessionTTL, "session-ttl", "how long an idle sticky session keeps its client")
+	fs.IntVar(&c.ProxyMaxPoolSize, "proxy-max-pool-size", c.ProxyMaxPoolSize, "pooled proxy connections per control")
+	fs.StringVar(&c.AuthTokenFile, "auth-token-file", c.AuthTokenFile, "file of accepted client tokens, one per line")
+	fs.StringVar(&c.AuthHMACSecret, "auth-hmac-secret", c.AuthHMACSecret, "secret for verifying HMAC signed client tokens")
+	fs.StringVar(&c.UserFile, "user-file", c.UserFile, "json file of the proxy users, empty accepts any credentials")
+	fs.StringVar(&c.PolicyFile, "policy-file", c.PolicyFile, "json file of destination rules by user and city, empty allows all")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token of the admin api, empty disables it")
+	fs.StringVar(&c.BanFile, "ban-file", c.BanFile, "file the banned clients are kept in, empty keeps them in memory")
+	fs.StringVar(&c.UsageFile, "usage-file", c.UsageFile, "file usage records are appended to as json lines")
+	fs.IntVar(&c.UsageFileMaxSize, "usage-file-max-size", c.UsageFileMaxSize, "rotate the usage file at this size in MB, 0 never rotates")
+	fs.IntVar(&c.UsageFileMaxBackups, "usage-file-max-backups", c.UsageFileMaxBackups, "rotated usage files to keep, 0 keeps all")
+	fs.StringVar(&c.UsageWebhook, "usage-webhook", c.UsageWebhook, "url usage records are posted to")
+	fs.StringVar(&c.UsageWebhookSpool, "usage-webhook-spool", c.UsageWebhookSpool, "file usage records are kept in while the webhook fails, empty drops them")
+	fs.Var(&c.RateLimit, "rate-limit", "bandwidth limit of all relayed traffic per second, e.g. 10MB, 0 is unlimited")
+	fs.Var(&c.UserRateLimit, "user-rate-limit", "bandwidth limit of each proxy user per second, 0 is unlimited")
+	fs.Var(&c.ClientRateLimit, "client-rate-limit", "bandwidth limit of each exit client per second, 0 is unlimited")
+	fs.IntVar(&c.ConnLimit, "conn-limit", c.ConnLimit, "concurrent connections of all proxy users, 0 is unlimited")
+	fs.IntVar(&c.UserConnLimit, "user-conn-limit", c.UserConnLimit, "concurrent connections of each proxy user, 0 is unlimited")
+	fs.Var(&c.ConnQueueTimeout, "conn-queue-timeout", "how long connections beyond a limit wait for a free slot, 0 rejects them")
+	fs.StringVar(&c.QuotaFile, "quota-file", c.QuotaFile, "file the traffic of clients against their quotas is kept in, empty keeps it in memory")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "certificate file, enables tls on the tunnel listener")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "private key file of -tls-cert")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "require client certificates signed by this CA")
+	return fs
+}
+
+// loadConfig builds the config from the command line arguments. It doesn't
+// validate it, so -print-config also shows incomplete configs.
+func loadConfig(args []string) (*Config, *commandFlags, error) {
+	cmd := &commandFlags{}
+
+	// the first pass only finds the config file
+	defaultConfig().flagSet(cmd).Parse(args)
+
+	c := defaultConfig()
+	if cmd.configFile != "" {
+		if err := util.LoadConfig(cmd.configFile, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := util.LoadEnv(c); err != nil {
+		return nil, nil, err
+	}
+	// flags override everything else
+	c.flagSet(cmd).Parse(args)
+	return c, cmd, nil
+}
+
+func (c *Config) validate() error {
+	for _, addr := range []string{c.TunnelAddr, c.SocksAddr, c.HttpAddr} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %v", addr, err)
+		}
+	}
+	if c.HttpProxyAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HttpProxyAddr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %v", c.HttpProxyAddr, err)
+		}
+	}
+	for _, d := range []util.Duration{c.PingTimeout, c.ReapInterval, c.WriteTimeout, c.ReadTimeout, c.ProxyStaleDuration, c.DialTimeout, c.HttpHeaderTimeout, c.HttpIdleTimeout, c.SessionTTL} {
+		if d <= 0 {
+			return errors.New("durations must be positive")
+		}
+	}
+	if _, err := NewSelector(c.Balance); err != nil {
+		return err
+	}
+	if c.ProxyMaxPoolSize <= 0 {
+		return errors.New("proxyMaxPoolSize must be positive")
+	}
+	if c.ConnLimit < 0 || c.UserConnLimit < 0 || c.ConnQueueTimeout < 0 {
+		return errors.New("connection limits must not be negative")
+	}
+	if c.UsageFileMaxSize < 0 || c.UsageFileMaxBackups < 0 {
+		return errors.New("usageFileMaxSize and usageFileMaxBackups must not be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tlsCert and tlsKey must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return errors.New("tlsClientCA requires tlsCert")
+	}
+	return nil
+}
+
+// print writes the config as json with the secrets masked.
+func (c *Config) print() {
+	b, _ := json.MarshalIndent(util.Redacted(c), "", "  ")
+	fmt.Println(string(b))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errTooManyConns = errors.New("too many concurrent connections")
+
+var (
+	globalConns *semaphore
+	userConns   *semaphoreSet
+)
+
+// semaphore limits concurrent connections, a nil semaphore is unlimited.
+type semaphore struct {
+	slots chan struct{}
+}
+
+func newSemaphore(n int) *semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &semaphore{slots: make(chan struct{}, n)}
+}
+
+// acquire takes a slot, waiting for one until deadline. A zero deadline
+// doesn't wait.
+func (s *semaphore) acquire(deadline time.Time) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	wait := time.Until(deadline)
+	if deadline.IsZero() || wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *semaphore) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
+
+// full reports whether acquire would have to wait.
+func (s *semaphore) full() bool {
+	return s != nil && len(s.slots) == cap(s.slots)
+}
+
+// used returns the slots taken and the size of the semaphore, 0 if it is
+// unlimited.
+func (s *semaphore) used() (n, size int) {
+	if s == nil {
+		return 0, 0
+	}
+	return len(s.slots), cap(s.slots)
+}
+
+// semaphoreSet holds a semaphore per user while the user has connections.
+type semaphoreSet struct {
+	size  func(key string) int
+	users map[string]*userSemaphore
+	sync.Mutex
+}
+
+type userSemaphore struct {
+	*semaphore
+	refs int
+}
+
+// newSemaphoreSet limits key to sizes[key] connections, or to def if sizes
+// has no entry for it; 0 is unlimited.
+func newSemaphoreSet(def int, sizes map[string]int) *semaphoreSet {
+	return &semaphoreSet{
+		size: func(key string) int {
+			if n, ok := sizes[key]; ok {
+				return n
+			}
+			return def
+		},
+		users: make(map[string]*userSemaphore),
+	}
+}
+
+// get returns the semaphore of key, which must be handed back with put.
+func (s *semaphoreSet) get(key string) *userSemaphore {
+	s.Lock()
+	defer s.Unlock()
+	u, ok := s.users[key]
+	if !ok {
+		u = &userSemaphore{semaphore: newSemaphore(s.size(key))}
+		s.users[key] = u
+	}
+	u.refs++
+	return u
+}
+
+func (s *semaphoreSet) put(key string, u *userSemaphore) {
+	s.Lock()
+	defer s.Unlock()
+	if u.refs--; u.refs == 0 {
+		delete(s.users, key)
+	}
+}
+
+func initConnLimits(c *Config) {
+	globalConns = newSemaphore(c.ConnLimit)
+	userConns = newSemaphoreSet(c.UserConnLimit, c.UserConnLimits)
+}
+
+// acquireConn takes a connection slot of ctl, of user and of the server,
+// queueing for at most the configured time when they are all taken. The
+// most specific slot is taken first, so a busy user or client waits while
+// holding only its own slots instead of one of the server that others
+// could use. The returned func gives the slots back once the connection is
+// done.
+func acquireConn(user string, ctl *Control) (release func(), err error) {
+	var deadline time.Time
+	if opts.ConnQueueTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(opts.ConnQueueTimeout))
+	}
+	u := userConns.get(user)
+	slots := []*semaphore{ctl.streams, u.semaphore, globalConns}
+	acquired := 0
+	for _, s := range slots {
+		if !s.acquire(deadline) {
+			break
+		}
+		acquired++
+	}
+	release = func() {
+		for _, s := range slots[:acquired] {
+			s.release()
+		}
+		userConns.put(user, u)
+	}
+	if acquired < len(slots) {
+		release()
+		return nil, errTooManyConns
+	}
+	return release, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/util"
+	"testing"
+	"time"
+)
+
+func TestAcquireConn(t *testing.T) {
+	opts = defaultConfig()
+	tests := []struct {
+		name                string
+		global, user, slots int // limits, 0 is unlimited
+		queue               time.Duration
+		held                []string // users holding a connection of the client beforehand
+		user2               string   // user of the new connection
+		ok                  bool
+	}{
+		{"unlimited", 0, 0, 0, 0, []string{"alice", "alice"}, "alice", true},
+		{"client full", 0, 0, 2, 0, []string{"alice", "bob"}, "carol", false},
+		{"user full", 0, 1, 0, 0, []string{"alice"}, "alice", false},
+		{"other user", 0, 1, 0, 0, []string{"alice"}, "bob", true},
+		{"server full", 2, 0, 0, 0, []string{"alice", "bob"}, "carol", false},
+		{"room left", 3, 2, 3, 0, []string{"alice", "bob"}, "alice", true},
+		{"queue times out", 0, 1, 0, 50 * time.Millisecond, []string{"alice"}, "alice", false},
+	}
+	for _, tt := range tests {
+		opts.ConnQueueTimeout = util.Duration(tt.queue)
+		globalConns = newSemaphore(tt.global)
+		userConns = newSemaphoreSet(tt.user, nil)
+		ctl := newTestControl("c", "110000", 0, 0)
+		ctl.streams = newSemaphore(tt.slots)
+		for _, u := range tt.held {
+			if _, err := acquireConn(u, ctl); err != nil {
+				t.Fatalf("%s: %s got no slot: %v", tt.name, u, err)
+			}
+		}
+		start := time.Now()
+		release, err := acquireConn(tt.user2, ctl)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if !tt.ok && err != errTooManyConns {
+			t.Errorf("%s: got %v, want %v", tt.name, err, errTooManyConns)
+		}
+		if waited := time.Since(start); waited < tt.queue || waited > tt.queue+time.Second {
+			t.Errorf("%s: waited %v, want %v", tt.name, waited, tt.queue)
+		}
+		if release != nil {
+			release()
+		}
+	}
+}
+
+// a connection rejected by a later limit gives back the slots it took
+// before, and a busy user doesn't hold slots of the server
+func TestAcquireConnReleases(t *testing.T) {
+	opts = defaultConfig()
+	opts.ConnQueueTimeout = util.Duration(50 * time.Millisecond)
+	globalConns = newSemaphore(2)
+	userConns = newSemaphoreSet(1, nil)
+	busy := newTestControl("busy", "110000", 0, 0)
+	busy.streams = newSemaphore(1)
+	idle := newTestControl("idle", "110000", 0, 0)
+	idle.streams = newSemaphore(1)
+
+	release, err := acquireConn("alice", busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client is full, the user and the server slots stay free while
+	// the connection queues for it
+	rejected := make(chan error, 1)
+	go func() {
+		_, err := acquireConn("bob", busy)
+		rejected <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n, _ := globalConns.used(); n != 1 {
+		t.Fatalf("%d server slots taken, want 1", n)
+	}
+	if u := userConns.get("bob"); u.full() {
+		t.Fatal("a queued connection holds the slot of its user")
+	} else {
+		userConns.put("bob", u)
+	}
+	if err = <-rejected; err != errTooManyConns {
+		t.Fatalf("got %v from a full client", err)
+	}
+	// the user is full, the slot of the idle client is given back
+	if _, err = acquireConn("alice", idle); err != errTooManyConns {
+		t.Fatalf("got %v from a full user", err)
+	}
+	if idle.streams.full() {
+		t.Fatal("a rejected connection kept the slot of its client")
+	}
+	second, err := acquireConn("bob", idle)
+	if err != nil {
+		t.Fatal("other users are blocked:", err)
+	}
+
+	// the server is full now, slots freed while queueing are taken
+	opts.ConnQueueTimeout = util.Duration(time.Second)
+	done := make(chan error, 1)
+	go func() {
+		release, err := acquireConn("carol", busy)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	release()
+	if err = <-done; err != nil {
+		t.Fatal("a queued connection got no slot:", err)
+	}
+	second()
+	if n, _ := globalConns.used(); n != 0 {
+		t.Fatalf("%d server slots left taken", n)
+	}
+	if len(userConns.users) != 0 {
+		t.Fatalf("%d user semaphores left", len(userConns.users))
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"github.com/snaigle/dproxy/msg"
 	"github.com/snaigle/dproxy/util"
@@ -8,18 +11,24 @@ import (
 	"log"
 	"net"
 	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	pingTimeoutInterval = 30 * time.Second
-	connReapInterval    = 10 * time.Second
-	controlWriteTimeout = 10 * time.Second
-	proxyStaleDuration  = 60 * time.Second
-	proxyMaxPoolSize    = 10
-)
-
 type Control struct {
+	// active proxied connections, the round trip time in microseconds
+	// the client last reported and the bytes relayed from and to the
+	// client, all accessed atomically and kept first for 64 bit alignment
+	active   int64
+	rtt      int64
+	bytesIn  int64
+	bytesOut int64
+
+	// set while draining, no new connections are assigned to the control
+	draining int32
+
 	// auth message
 	auth *msg.Auth
 
@@ -41,8 +50,43 @@ type Control struct {
 	// proxy connections
 	proxies chan net.Conn
 
+	// multiplexed sessions registered by the client, streams are opened on
+	// them instead of using pooled proxy connections
+	sessions       []*msg.Session
+	sessionsClosed bool
+	sessionsLock   sync.Mutex
+
 	// identifier
 	id string
+
+	// who the client authenticated as, see clientIdentity
+	identity string
+
+	// proves that proxy connections and sessions belong to this control,
+	// unlike the id it is only known to the client
+	secret string
+
+	// when the client connected
+	created time.Time
+
+	// traffic of the client id against the quotas of auth
+	quota *quotaUsage
+
+	// slots of the concurrent connections the client accepts, nil if it
+	// didn't limit them
+	streams *semaphore
+
+	// synchronizer for controlled shutdown of writer()
+	writerShutdown *util.Shutdown
+
+	// synchronizer for controlled shutdown of reader()
+	readerShutdown *util.Shutdown
+
+	// synchronizer for controlled shutdown of manager()
+	managerShutdown *util.Shutdown
+
+	// synchronizer for controller shutdown of entire Control
+	shutdown *util.Shutdown
 }
 
 func newControl(ctlConn net.Conn, authMsg *msg.Auth) {
@@ -51,27 +95,88 @@ func newControl(ctlConn net.Conn, authMsg *msg.Auth) {
 		conn:     ctlConn,
 		out:      make(chan msg.Message),
 		in:       make(chan msg.Message),
-		proxies:  make(chan net.Conn, 10),
+		proxies:  make(chan net.Conn, opts.ProxyMaxPoolSize),
 		lastPing: time.Now(),
+		created:  time.Now(),
+		streams:  newSemaphore(authMsg.MaxStreams),
+		secret:   util.RandSecret(16),
+
+		writerShutdown:  util.NewShutdown(),
+		readerShutdown:  util.NewShutdown(),
+		managerShutdown: util.NewShutdown(),
+		shutdown:        util.NewShutdown(),
 	}
-	// todo auth token
-	log.Printf("auth info:%v\n", authMsg)
-	if authMsg.CityCode == "" {
-		panic("auth error: cityCode could't be empty")
+	log.Printf("auth from %s, cityCode:%s\n", ctlConn.RemoteAddr(), authMsg.CityCode)
+	if err := authenticate(ctlConn, authMsg); err != nil {
+		log.Printf("auth failed from %s: %v\n", ctlConn.RemoteAddr(), err)
+		ctlConn.SetWriteDeadline(time.Now().Add(time.Duration(opts.WriteTimeout)))
+		msg.WriteMsg(ctlConn, &msg.AuthResp{Error: err.Error()})
+		ctlConn.Close()
+		return
 	}
-	c.id = util.RandString(16)
-	log.Println("clientId:", c.id)
-	if replaced := controlRegistry.Add(c.id, c); replaced != nil {
-		log.Println("control is same :", c.id)
+	if authMsg.Weight > maxWeight {
+		authMsg.Weight = maxWeight
+	}
+	c.identity = clientIdentity(ctlConn, authMsg)
+	if strings.HasPrefix(c.identity, "cert:") {
+		// a verified client certificate is a stronger identity than
+		// whatever device id the client claims
+		c.id = deviceClientId(c.identity)
+	} else if authMsg.DeviceId != "" {
+		// the client makes its device id up, so it only tells apart the
+		// devices sharing credentials; otherwise any client could take
+		// over the id and the sessions of another one
+		c.id = deviceClientId(c.identity + ":" + authMsg.DeviceId)
+	} else {
+		c.id = util.RandString(16)
 	}
+	log.Println("clientId:", c.id)
+	c.quota = quotaTracker.Usage(c.id)
+	controlRegistry.Add(c.id, c)
 	go c.writer()
 	c.out <- &msg.AuthResp{
 		ClientId: c.id,
+		Secret:   c.secret,
 	}
 	c.out <- &msg.ReqProxy{}
 	go c.manager()
 	go c.reader()
+	go c.stopper()
+}
+
+// deviceClientId derives a stable client id from a device identity, so
+// SOCKS users keep their client id when the device reconnects. The id is
+// hashed because client ids are handed out by the query api.
+func deviceClientId(deviceId string) string {
+	sum := sha256.Sum256([]byte(deviceId))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Replaced is called when a new control connection authenticates with the
+// same client id. The old control shuts down so its client stops using it.
+func (c *Control) Replaced(replacement *Control) {
+	log.Printf("control %s replaced by connection from %s\n", c.id, replacement.conn.RemoteAddr())
+	c.shutdown.Begin()
+}
+
+// Kick shuts the control down, its client is free to reconnect.
+func (c *Control) Kick(reason string) {
+	log.Printf("control %s kicked: %s\n", c.id, reason)
+	c.shutdown.Begin()
+}
+
+// SetDraining puts the control in or out of drain mode. Draining controls
+// don't get new connections but keep the ones they serve.
+func (c *Control) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&c.draining, v)
+}
 
+func (c *Control) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
 }
 
 func (c *Control) writer() {
@@ -81,10 +186,22 @@ func (c *Control) writer() {
 		}
 	}()
 
+	// kill everything if the writer() stops
+	defer c.shutdown.Begin()
+
+	// notify that we've flushed all messages
+	defer c.writerShutdown.Complete()
+
 	// write messages to the control channel
 	for m := range c.out {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Duration(opts.WriteTimeout)))
 		if err := msg.WriteMsg(c.conn, m); err != nil {
-			panic(err)
+			log.Printf("control %s write failed: %v\n", c.id, err)
+			c.shutdown.Begin()
+			// keep draining so senders don't block until out is closed
+			for range c.out {
+			}
+			return
 		}
 	}
 }
@@ -96,29 +213,91 @@ func (c *Control) reader() {
 		}
 	}()
 
+	// kill everything if the reader stops
+	defer c.shutdown.Begin()
+
+	// notify that we're done
+	defer c.readerShutdown.Complete()
+
 	// read messages from the control channel
 	for {
 		if msg, err := msg.ReadMsg(c.conn); err != nil {
 			if err == io.EOF {
 				log.Println("EOF")
-				return
 			} else {
-				panic(err)
+				log.Printf("control %s read failed: %v\n", c.id, err)
 			}
+			return
 		} else {
 			// this can also panic during shutdown
 			c.in <- msg
 		}
 	}
 }
+
+// stopper waits for the shutdown to begin, then tears the control down:
+// it leaves the registry, stops the manager and writer, closes the
+// connection and every pooled proxy connection. Callers blocked in
+// GetProxy fail as soon as the proxies channel is closed.
+func (c *Control) stopper() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Failed to shut down control %s: %v\n", c.id, r)
+		}
+	}()
+
+	// wait until we're instructed to shutdown
+	c.shutdown.WaitBegin()
+
+	// remove ourself from the control registry
+	controlRegistry.Del(c.id, c)
+	quotaTracker.Release(c.id)
+
+	// shutdown manager() so that we have no more work to do
+	close(c.in)
+	c.managerShutdown.WaitComplete()
+
+	// shutdown writer()
+	close(c.out)
+	c.writerShutdown.WaitComplete()
+
+	// close connection fully
+	c.conn.Close()
+
+	// close the multiplexed sessions and their streams
+	c.sessionsLock.Lock()
+	c.sessionsClosed = true
+	sessions := c.sessions
+	c.sessions = nil
+	c.sessionsLock.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
+
+	// shutdown all of the proxy connections
+	close(c.proxies)
+	for p := range c.proxies {
+		p.Close()
+	}
+
+	c.shutdown.Complete()
+	log.Println("control shutdown complete:", c.id)
+}
+
 func (c *Control) RegisterProxy(conn net.Conn) {
 
-	conn.SetDeadline(time.Now().Add(proxyStaleDuration))
-	select {
-	case c.proxies <- conn:
-		log.Println("Registered")
-	default:
-		log.Println("Proxies buffer is full, discarding.")
+	conn.SetDeadline(time.Now().Add(time.Duration(opts.ProxyStaleDuration)))
+	err := util.PanicToError(func() {
+		select {
+		case c.proxies <- conn:
+			log.Println("Registered")
+		default:
+			log.Println("Proxies buffer is full, discarding.")
+			conn.Close()
+		}
+	})
+	if err != nil {
+		log.Println("control is closing, discarding proxy:", c.id)
 		conn.Close()
 	}
 }
@@ -131,15 +310,22 @@ func (c *Control) manager() {
 		}
 	}()
 
+	// kill everything if the manager stops
+	defer c.shutdown.Begin()
+
+	// notify that manager() has shutdown
+	defer c.managerShutdown.Complete()
+
 	// reaping timer for detecting heartbeat failure
-	reap := time.NewTicker(connReapInterval)
+	reap := time.NewTicker(time.Duration(opts.ReapInterval))
 	defer reap.Stop()
 
 	for {
 		select {
 		case <-reap.C:
-			if time.Since(c.lastPing) > pingTimeoutInterval {
+			if time.Since(c.lastPing) > time.Duration(opts.PingTimeout) {
 				log.Printf("Lost heartbeat")
+				c.shutdown.Begin()
 			}
 
 		case mRaw, ok := <-c.in:
@@ -151,6 +337,10 @@ func (c *Control) manager() {
 			switch m := mRaw.(type) {
 			case *msg.Ping:
 				c.lastPing = time.Now()
+				if m.Rtt > 0 {
+					atomic.StoreInt64(&c.rtt, m.Rtt)
+					heartbeatRtt.Observe(float64(m.Rtt) / 1e6)
+				}
 				c.out <- &msg.Pong{}
 			default:
 				log.Println("msg type:", m)
@@ -159,9 +349,122 @@ func (c *Control) manager() {
 	}
 }
 
+// RegisterSession adds a multiplexed session to the control. It is removed
+// again when it closes.
+func (c *Control) RegisterSession(sess *msg.Session) {
+	c.sessionsLock.Lock()
+	if c.sessionsClosed {
+		c.sessionsLock.Unlock()
+		log.Println("control is closing, discarding session:", c.id)
+		sess.Close()
+		return
+	}
+	c.sessions = append(c.sessions, sess)
+	c.sessionsLock.Unlock()
+	log.Println("Registered session from", sess.RemoteAddr())
+
+	go func() {
+		<-sess.CloseChan()
+		c.sessionsLock.Lock()
+		defer c.sessionsLock.Unlock()
+		for i, s := range c.sessions {
+			if s == sess {
+				c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+				break
+			}
+		}
+		log.Println("Session closed from", sess.RemoteAddr())
+	}()
+}
+
+// openStream opens a stream on the least busy multiplexed session. It
+// returns nil if the client has no usable session.
+func (c *Control) openStream() net.Conn {
+	c.sessionsLock.Lock()
+	var best *msg.Session
+	for _, sess := range c.sessions {
+		if best == nil || sess.NumStreams() < best.NumStreams() {
+			best = sess
+		}
+	}
+	c.sessionsLock.Unlock()
+	if best == nil {
+		return nil
+	}
+	stream, err := best.Open()
+	if err != nil {
+		log.Println("Failed to open stream:", err)
+		return nil
+	}
+	return stream
+}
+
+// NumSessions returns the number of multiplexed sessions of the control.
+func (c *Control) NumSessions() int {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	return len(c.sessions)
+}
+
+// Active returns the number of proxied connections in use.
+func (c *Control) Active() int64 {
+	return atomic.LoadInt64(&c.active)
+}
+
+// Rtt returns the round trip time of the control connection in
+// microseconds, 0 if the client didn't report it.
+func (c *Control) Rtt() int64 {
+	return atomic.LoadInt64(&c.rtt)
+}
+
+// Relayed returns the bytes received from and sent to the client over its
+// proxied connections.
+func (c *Control) Relayed() (in, out int64) {
+	return atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut)
+}
+
+// OverQuota reports whether the client relayed its daily or monthly quota.
+func (c *Control) OverQuota() bool {
+	day, month := c.quota.Used()
+	return c.auth.DailyQuota > 0 && day >= c.auth.DailyQuota ||
+		c.auth.MonthlyQuota > 0 && month >= c.auth.MonthlyQuota
+}
+
+// Available reports whether new connections may be assigned to the
+// control, which is neither draining nor over its quota.
+func (c *Control) Available() bool {
+	return !c.Draining() && !c.OverQuota()
+}
+
+// maxWeight caps the weight a client may ask for, so no client takes all
+// the traffic and the weights of many clients still add up.
+const maxWeight = 1000
+
+// Weight returns the share of traffic the client asked for.
+func (c *Control) Weight() int {
+	if c.auth.Weight > 0 {
+		return c.auth.Weight
+	}
+	return 1
+}
+
 func (c *Control) GetProxy() (proxyConn net.Conn, err error) {
 	var ok bool
 
+	if c.Draining() {
+		err = fmt.Errorf("control %s is draining", c.id)
+		return
+	}
+	if c.OverQuota() {
+		err = fmt.Errorf("control %s is over its quota", c.id)
+		return
+	}
+
+	// prefer a stream over a multiplexed session
+	if proxyConn = c.openStream(); proxyConn != nil {
+		return
+	}
+
 	// get a proxy connection from the pool
 	select {
 	case proxyConn, ok = <-c.proxies:
@@ -190,7 +493,7 @@ func (c *Control) GetProxy() (proxyConn net.Conn, err error) {
 				return
 			}
 
-		case <-time.After(pingTimeoutInterval):
+		case <-time.After(time.Duration(opts.PingTimeout)):
 			err = fmt.Errorf("Timeout trying to get proxy connection")
 			return
 		}
@@ -210,5 +513,29 @@ func newProxy(proxyConn net.Conn, regProxy *msg.RegProxy) {
 	if ctl == nil {
 		panic("no client found for clientId:" + regProxy.ClientId)
 	}
+	if !ctl.owns(regProxy.Secret) {
+		panic("invalid secret for clientId:" + regProxy.ClientId)
+	}
 	ctl.RegisterProxy(proxyConn)
 }
+
+func newMuxSession(conn net.Conn, regMux *msg.RegMux) {
+	ctl := controlRegistry.Get(regMux.ClientId)
+	if ctl == nil {
+		log.Println("no client found for clientId:", regMux.ClientId)
+		conn.Close()
+		return
+	}
+	if !ctl.owns(regMux.Secret) {
+		log.Printf("invalid secret for clientId %s from %s\n", regMux.ClientId, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	ctl.RegisterSession(msg.NewSession(conn, false, false))
+}
+
+// owns reports whether secret is the one the control handed its client,
+// so a connection registered with it comes from that client.
+func (c *Control) owns(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(c.secret)) == 1
+}
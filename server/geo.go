@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	earthRadiusKm = 6371.0
+
+	// half the circumference, no two points are further apart
+	maxDistanceKm = math.Pi * earthRadiusKm
+
+	// grid cells are geoCellSize degrees wide and high
+	geoCellSize = 1.0
+	geoLngCells = int(360 / geoCellSize)
+)
+
+// GeoMatch is a control found by a geo query and its distance in km.
+type GeoMatch struct {
+	Control  *Control
+	Distance float64
+}
+
+type geoCell struct {
+	lat, lng int
+}
+
+// GeoIndex is a grid index over the gps positions of controls. Clients
+// which don't report a position (0, 0) aren't indexed. It isn't safe for
+// concurrent use, ControlRegistry guards it with its lock.
+type GeoIndex struct {
+	cells map[geoCell][]*Control
+}
+
+func NewGeoIndex() *GeoIndex {
+	return &GeoIndex{cells: make(map[geoCell][]*Control)}
+}
+
+func hasPosition(ctl *Control) bool {
+	return ctl.auth.GpsLat != 0 || ctl.auth.GpsLit != 0
+}
+
+func cellOf(lat, lng float64) geoCell {
+	return geoCell{
+		lat: int(math.Floor(lat / geoCellSize)),
+		lng: lngCell(int(math.Floor((lng + 180) / geoCellSize))),
+	}
+}
+
+func lngCell(i int) int {
+	return ((i % geoLngCells) + geoLngCells) % geoLngCells
+}
+
+func (g *GeoIndex) Add(ctl *Control) {
+	if !hasPosition(ctl) {
+		return
+	}
+	cell := cellOf(ctl.auth.GpsLat, ctl.auth.GpsLit)
+	g.cells[cell] = append(g.cells[cell], ctl)
+}
+
+func (g *GeoIndex) Remove(ctl *Control) {
+	if !hasPosition(ctl) {
+		return
+	}
+	cell := cellOf(ctl.auth.GpsLat, ctl.auth.GpsLit)
+	controls := g.cells[cell]
+	for i, c := range controls {
+		if c == ctl {
+			controls = append(controls[:i], controls[i+1:]...)
+			break
+		}
+	}
+	if len(controls) == 0 {
+		delete(g.cells, cell)
+	} else {
+		g.cells[cell] = controls
+	}
+}
+
+// Within returns the controls accepted by f within radius km of lat/lng,
+// nearest first.
+func (g *GeoIndex) Within(lat, lng, radius float64, f func(*Control) bool) []GeoMatch {
+	var matches []GeoMatch
+	check := func(cell geoCell) {
+		for _, ctl := range g.cells[cell] {
+			d := haversine(lat, lng, ctl.auth.GpsLat, ctl.auth.GpsLit)
+			if d <= radius && f(ctl) {
+				matches = append(matches, GeoMatch{Control: ctl, Distance: d})
+			}
+		}
+	}
+
+	// the bounding box of the circle, all longitudes if it covers a pole
+	dLat := radius / earthRadiusKm * 180 / math.Pi
+	minLat, maxLat := cellOf(lat-dLat, 0).lat, cellOf(lat+dLat, 0).lat
+	var dLng float64
+	if lat+dLat >= 90 || lat-dLat <= -90 {
+		dLng = 180
+	} else {
+		maxAbsLat := math.Max(math.Abs(lat-dLat), math.Abs(lat+dLat))
+		dLng = dLat / math.Cos(maxAbsLat*math.Pi/180)
+	}
+	for i := minLat; i <= maxLat; i++ {
+		if dLng >= 180 {
+			for j := 0; j < geoLngCells; j++ {
+				check(geoCell{i, j})
+			}
+			continue
+		}
+		first := int(math.Floor((lng + 180 - dLng) / geoCellSize))
+		last := int(math.Floor((lng + 180 + dLng) / geoCellSize))
+		if last-first >= geoLngCells {
+			last = first + geoLngCells - 1
+		}
+		for j := first; j <= last; j++ {
+			check(geoCell{i, lngCell(j)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Distance < matches[j].Distance })
+	return matches
+}
+
+// Nearest returns up to n controls accepted by f, nearest to lat/lng first.
+func (g *GeoIndex) Nearest(lat, lng float64, n int, f func(*Control) bool) []GeoMatch {
+	// widen the search until it finds enough, anything nearer than the
+	// matches is inside the searched radius as well
+	for radius := 50.0; ; radius *= 2 {
+		matches := g.Within(lat, lng, radius, f)
+		if len(matches) >= n || radius >= maxDistanceKm {
+			if len(matches) > n {
+				matches = matches[:n]
+			}
+			return matches
+		}
+	}
+}
+
+// haversine returns the great-circle distance between two points in km.
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
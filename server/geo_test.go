@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func matchIds(matches []GeoMatch) []string {
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = m.Control.id
+	}
+	return ids
+}
+
+func equalIds(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func acceptAll(*Control) bool { return true }
+
+func TestHaversine(t *testing.T) {
+	tests := []struct {
+		lat1, lng1, lat2, lng2, km float64
+	}{
+		{39.9, 116.4, 39.9, 116.4, 0},
+		{39.9042, 116.4074, 31.2304, 121.4737, 1067},
+		{0, 0, 0, 180, math.Pi * earthRadiusKm},
+		{90, 0, -90, 0, math.Pi * earthRadiusKm},
+		{0.5, 179.9, 0.5, -179.9, 22.2},
+	}
+	for _, tt := range tests {
+		if d := haversine(tt.lat1, tt.lng1, tt.lat2, tt.lng2); math.Abs(d-tt.km) > 1 {
+			t.Errorf("haversine(%v, %v, %v, %v) = %.1f, want %.1f", tt.lat1, tt.lng1, tt.lat2, tt.lng2, d, tt.km)
+		}
+	}
+}
+
+func TestGeoIndex(t *testing.T) {
+	g := NewGeoIndex()
+	controls := []*Control{
+		newTestControl("beijing", "110000", 39.9042, 116.4074),
+		newTestControl("tianjin", "120000", 39.3434, 117.3616),
+		newTestControl("shanghai", "310000", 31.2304, 121.4737),
+		newTestControl("sydney", "sydney", -33.8688, 151.2093),
+		newTestControl("fiji", "fiji", -17.7134, 178.065),
+		newTestControl("samoa", "samoa", -13.759, -172.1046),
+		newTestControl("svalbard", "svalbard", 89.5, 10),
+		// no position, not indexed
+		newTestControl("unknown", "110000", 0, 0),
+	}
+	for _, ctl := range controls {
+		g.Add(ctl)
+	}
+	notBeijing := func(ctl *Control) bool { return ctl.id != "beijing" }
+
+	within := []struct {
+		lat, lng, radius float64
+		f                func(*Control) bool
+		want             []string
+	}{
+		{39.9, 116.4, 10, acceptAll, []string{"beijing"}},
+		{39.9, 116.4, 150, acceptAll, []string{"beijing", "tianjin"}},
+		{39.9, 116.4, 150, notBeijing, []string{"tianjin"}},
+		{39.3, 117.3, 150, acceptAll, []string{"tianjin", "beijing"}},
+		{30.27, 120.15, 100, acceptAll, nil},
+		{30.27, 120.15, 200, acceptAll, []string{"shanghai"}},
+		// across the antimeridian
+		{-15, 179.9, 600, acceptAll, []string{"fiji"}},
+		{-15, -179.9, 1000, acceptAll, []string{"fiji", "samoa"}},
+		// over the pole
+		{89.5, -170, 200, acceptAll, []string{"svalbard"}},
+		{0, 0, 100, acceptAll, nil},
+	}
+	for _, tt := range within {
+		got := matchIds(g.Within(tt.lat, tt.lng, tt.radius, tt.f))
+		if !equalIds(got, tt.want) {
+			t.Errorf("Within(%v, %v, %v) = %v, want %v", tt.lat, tt.lng, tt.radius, got, tt.want)
+		}
+	}
+
+	nearest := []struct {
+		lat, lng float64
+		n        int
+		f        func(*Control) bool
+		want     []string
+	}{
+		{30.27, 120.15, 1, acceptAll, []string{"shanghai"}},
+		{30.27, 120.15, 3, acceptAll, []string{"shanghai", "tianjin", "beijing"}},
+		{39.9, 116.4, 1, notBeijing, []string{"tianjin"}},
+		{-35, 149, 1, acceptAll, []string{"sydney"}},
+		{-15, -179.9, 2, acceptAll, []string{"fiji", "samoa"}},
+		{0, 0, 10, func(*Control) bool { return false }, nil},
+		{0, 0, 10, acceptAll, []string{"svalbard", "beijing", "tianjin", "shanghai", "sydney", "fiji", "samoa"}},
+	}
+	for _, tt := range nearest {
+		got := matchIds(g.Nearest(tt.lat, tt.lng, tt.n, tt.f))
+		if !equalIds(got, tt.want) {
+			t.Errorf("Nearest(%v, %v, %d) = %v, want %v", tt.lat, tt.lng, tt.n, got, tt.want)
+		}
+	}
+
+	g.Remove(controls[0])
+	g.Remove(controls[len(controls)-1])
+	if got := matchIds(g.Within(39.9, 116.4, 150, acceptAll)); !equalIds(got, []string{"tianjin"}) {
+		t.Errorf("Within after Remove = %v, want [tianjin]", got)
+	}
+}
+
+// TestGeoIndexWithin compares the grid search with checking every control.
+func TestGeoIndexWithin(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	g := NewGeoIndex()
+	var controls []*Control
+	for i := 0; i < 500; i++ {
+		lat, lng := rnd.Float64()*180-90, rnd.Float64()*360-180
+		ctl := newTestControl(string(rune('a'+i%26))+string(rune('a'+i/26)), "", lat, lng)
+		controls = append(controls, ctl)
+		g.Add(ctl)
+	}
+	for i := 0; i < 200; i++ {
+		lat, lng := rnd.Float64()*180-90, rnd.Float64()*360-180
+		radius := math.Pow(10, rnd.Float64()*4)
+		var want []string
+		for _, ctl := range controls {
+			if haversine(lat, lng, ctl.auth.GpsLat, ctl.auth.GpsLit) <= radius {
+				want = append(want, ctl.id)
+			}
+		}
+		got := matchIds(g.Within(lat, lng, radius, acceptAll))
+		sort.Strings(want)
+		sort.Strings(got)
+		if !equalIds(got, want) {
+			t.Fatalf("Within(%v, %v, %v) = %v, want %v", lat, lng, radius, got, want)
+		}
+	}
+}
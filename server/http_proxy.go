@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"github.com/snaigle/dproxy/msg"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hop-by-hop headers, they apply to a single connection and must not be
+// forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func listenHttpProxy(listenAddr string) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("listen http proxy connection")
+	server := &http.Server{
+		Handler:           http.HandlerFunc(handleHttpProxy),
+		ReadHeaderTimeout: time.Duration(opts.HttpHeaderTimeout),
+		IdleTimeout:       time.Duration(opts.HttpIdleTimeout),
+	}
+	log.Fatal(server.Serve(ln))
+}
+
+// sessionHeader sets the sticky session of a request, it takes precedence
+// over the session in the credentials
+const sessionHeader = "X-Proxy-Session"
+
+// handleHttpProxy serves CONNECT and absolute-URI requests. Like the socks
+// handshake, the credentials of the Proxy-Authorization header select the
+// client, see parseRoute.
+func handleHttpProxy(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="dproxy"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	route, err := proxyRoute(username, password)
+	if err != nil {
+		log.Printf("rejected user %q: %v\n", username, err)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="dproxy"`)
+		http.Error(w, err.Error(), http.StatusProxyAuthRequired)
+		return
+	}
+	if session := req.Header.Get(sessionHeader); session != "" {
+		route.Session = session
+	}
+	ctl, err := routeControl(route)
+	if err != nil {
+		log.Printf("no proxy for user %q: %v\n", username, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	release, err := acquireConn(limitUser(username, route), ctl)
+	if err != nil {
+		log.Printf("rejected request of user %q to client %s: %v\n", username, ctl.id, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	if req.Method == http.MethodConnect {
+		httpConnect(w, req, route, ctl, username)
+		return
+	}
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		http.Error(w, "only absolute http urls and CONNECT are supported", http.StatusBadRequest)
+		return
+	}
+	httpForward(w, req, route, ctl, username)
+}
+
+func parseProxyAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return
+	}
+	idx := strings.IndexByte(string(b), ':')
+	if idx < 0 {
+		return
+	}
+	return string(b[:idx]), string(b[idx+1:]), true
+}
+
+// httpStatusCode maps an error from getProxyConn to a response status.
+func httpStatusCode(err error) int {
+	if de, ok := err.(*dialError); ok {
+		switch de.Reason {
+		case msg.DialErrTimeout:
+			return http.StatusGatewayTimeout
+		case msg.DialErrNotAllowed:
+			return http.StatusForbidden
+		}
+	}
+	return http.StatusBadGateway
+}
+
+func httpConnect(w http.ResponseWriter, req *http.Request, route *Route, ctl *Control, user string) {
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		http.Error(w, "CONNECT needs host:port", http.StatusBadRequest)
+		return
+	}
+	if !allowDest(user, route, ctl, addr) {
+		log.Printf("rejected request of user %q to %s: %v\n", user, addr, errDestNotAllowed)
+		http.Error(w, errDestNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	log.Println("accept http connect:", addr)
+	proxy, result, err := getProxyConn(ctl, addr)
+	if err != nil {
+		log.Println("failed get proxy connection:", err)
+		http.Error(w, err.Error(), httpStatusCode(err))
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		proxy.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		proxy.Close()
+		log.Println("failed to hijack connection:", err)
+		return
+	}
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		proxy.Close()
+		return
+	}
+	u := newUsage(user, route, ctl, usageHttpConnect, addr)
+	u.connected(result)
+	// the client may have sent data right after the request
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		if _, err = proxy.Write(b); err != nil {
+			conn.Close()
+			proxy.Close()
+			return
+		}
+		u.BytesUp = int64(n)
+	}
+	relay(conn, proxy, u)
+	log.Println("closed http connect to", addr)
+}
+
+func httpForward(w http.ResponseWriter, req *http.Request, route *Route, ctl *Control, user string) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	if !allowDest(user, route, ctl, addr) {
+		log.Printf("rejected request of user %q to %s: %v\n", user, addr, errDestNotAllowed)
+		http.Error(w, errDestNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	log.Println("accept http request:", req.URL)
+	proxy, result, err := getProxyConn(ctl, addr)
+	if err != nil {
+		log.Println("failed get proxy connection:", err)
+		http.Error(w, err.Error(), httpStatusCode(err))
+		return
+	}
+	defer proxy.Close()
+	u := newUsage(user, route, ctl, usageHttp, addr)
+	u.connected(result)
+	counter := &countingConn{Conn: proxy, u: u}
+	reason := closeByExitError
+	defer func() {
+		u.BytesUp, u.BytesDown = counter.written, counter.read
+		u.finish(reason)
+	}()
+
+	outReq := req.Clone(req.Context())
+	removeHopHeaders(outReq.Header)
+	outReq.Header.Del(sessionHeader)
+	// one request per proxy connection
+	outReq.Close = true
+	if err = outReq.Write(counter); err != nil {
+		log.Println("failed to write request:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(counter), outReq)
+	if err != nil {
+		log.Println("failed to read response:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		log.Printf("failed to copy response of %s: %v\n", req.URL, err)
+		return
+	}
+	reason = closeByExit
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range strings.Split(h.Get("Connection"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			h.Del(f)
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
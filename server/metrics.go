@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are served in the prometheus text format, written by hand to
+// keep the server free of dependencies.
+
+// socks connection failures by reason, beside the reasons of DialResult
+const (
+	socksFailHandshake  = "handshake"
+	socksFailNoRoute    = "no-route"
+	socksFailRequest    = "bad-request"
+	socksFailNoProxy    = "no-proxy"
+	socksFailConnLimit  = "conn-limit"
+	socksFailAuth       = "auth"
+	socksFailNotAllowed = "not-allowed"
+)
+
+var (
+	socksAccepted = &Counter{}
+	socksFailed   = NewCounterVec()
+
+	getProxySeconds = NewHistogram(.001, .005, .01, .05, .1, .5, 1, 5, 10, 30)
+	heartbeatRtt    = NewHistogram(.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5)
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value float64
+	sync.Mutex
+}
+
+func (c *Counter) Add(v float64) {
+	c.Lock()
+	c.value += v
+	c.Unlock()
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.value
+}
+
+// CounterVec is a set of counters told apart by the value of one label.
+type CounterVec struct {
+	values map[string]float64
+	sync.Mutex
+}
+
+func NewCounterVec() *CounterVec {
+	return &CounterVec{values: make(map[string]float64)}
+}
+
+func (c *CounterVec) Inc(label string) {
+	c.Lock()
+	c.values[label]++
+	c.Unlock()
+}
+
+func (c *CounterVec) snapshot() map[string]float64 {
+	c.Lock()
+	defer c.Unlock()
+	values := make(map[string]float64, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+// Histogram counts observations in buckets with the given upper bounds.
+type Histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+	sync.Mutex
+}
+
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	h.sum += v
+	h.count++
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// metricsWriter writes the text exposition format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value, labels alternate between names and values.
+func (w metricsWriter) sample(name string, v float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func (w metricsWriter) histogram(name, help string, h *Histogram) {
+	w.header(name, "histogram", help)
+	h.Lock()
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		w.sample(name+"_bucket", float64(cumulative), "le", formatFloat(bound))
+	}
+	w.sample(name+"_bucket", float64(h.count), "le", "+Inf")
+	w.sample(name+"_sum", h.sum)
+	w.sample(name+"_count", float64(h.count))
+	h.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		// counts and bytes read better without an exponent
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := metricsWriter{bufio.NewWriter(resp)}
+	defer w.Flush()
+
+	controls := controlRegistry.Filter(func(*Control) bool { return true })
+	perCity := make(map[string]float64)
+	for _, ctl := range controls {
+		perCity[ctl.auth.CityCode]++
+	}
+	w.header("dproxy_controls", "gauge", "Connected exit clients by city.")
+	for _, city := range sortedKeys(perCity) {
+		w.sample("dproxy_controls", perCity[city], "city", city)
+	}
+
+	w.header("dproxy_socks_connections_accepted_total", "counter", "Accepted socks5 connections.")
+	w.sample("dproxy_socks_connections_accepted_total", socksAccepted.Value())
+	failed := socksFailed.snapshot()
+	w.header("dproxy_socks_connections_failed_total", "counter", "Failed socks5 connections by reason.")
+	for _, reason := range sortedKeys(failed) {
+		w.sample("dproxy_socks_connections_failed_total", failed[reason], "reason", reason)
+	}
+
+	w.header("dproxy_proxy_pool_size", "gauge", "Idle pooled proxy connections of an exit client.")
+	for _, ctl := range controls {
+		w.sample("dproxy_proxy_pool_size", float64(len(ctl.proxies)), "client_id", ctl.id, "city", ctl.auth.CityCode)
+	}
+	w.header("dproxy_active_connections", "gauge", "Proxied connections in use of an exit client.")
+	for _, ctl := range controls {
+		w.sample("dproxy_active_connections", float64(ctl.Active()), "client_id", ctl.id, "city", ctl.auth.CityCode)
+	}
+	w.header("dproxy_relayed_bytes_total", "counter", "Bytes relayed through an exit client, out is towards the target.")
+	for _, ctl := range controls {
+		in, out := ctl.Relayed()
+		w.sample("dproxy_relayed_bytes_total", float64(in), "client_id", ctl.id, "city", ctl.auth.CityCode, "direction", "in")
+		w.sample("dproxy_relayed_bytes_total", float64(out), "client_id", ctl.id, "city", ctl.auth.CityCode, "direction", "out")
+	}
+
+	w.histogram("dproxy_get_proxy_seconds", "Time to get a proxy connection from an exit client.", getProxySeconds)
+	w.histogram("dproxy_heartbeat_rtt_seconds", "Heartbeat round trip times reported by exit clients.", heartbeatRtt)
+}
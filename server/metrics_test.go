@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{42, "42"},
+		{-3, "-3"},
+		{1 << 40, "1099511627776"},
+		{0.005, "0.005"},
+		{2.5, "2.5"},
+		{1e20, "1e+20"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, tt := range tests {
+		if got := formatFloat(tt.v); got != tt.want {
+			t.Errorf("formatFloat(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsSample(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      float64
+		labels []string
+		want   string
+	}{
+		{"up", 1, nil, "up 1\n"},
+		{"conns", 3, []string{"city", "110000"}, `conns{city="110000"} 3` + "\n"},
+		{"conns", 3, []string{"city", "110000", "client_id", "a"}, `conns{city="110000",client_id="a"} 3` + "\n"},
+		{"conns", 0.5, []string{"city", `a"b\c` + "\nd"}, `conns{city="a\"b\\c\nd"} 0.5` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := metricsWriter{bufio.NewWriter(&buf)}
+		w.sample(tt.name, tt.v, tt.labels...)
+		w.Flush()
+		if buf.String() != tt.want {
+			t.Errorf("sample(%s, %v, %q) wrote %q, want %q", tt.name, tt.v, tt.labels, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	h := NewHistogram(.1, 1, 10)
+	for _, v := range []float64{.05, .1, .5, 1, 20, 30} {
+		h.Observe(v)
+	}
+	var buf bytes.Buffer
+	w := metricsWriter{bufio.NewWriter(&buf)}
+	w.histogram("t_seconds", "Test.", h)
+	w.Flush()
+	want := `# HELP t_seconds Test.
+# TYPE t_seconds histogram
+t_seconds_bucket{le="0.1"} 2
+t_seconds_bucket{le="1"} 4
+t_seconds_bucket{le="10"} 4
+t_seconds_bucket{le="+Inf"} 6
+t_seconds_sum 51.65
+t_seconds_count 6
+`
+	if buf.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// the text format: comments, or a metric name, optional labels and a value
+var metricLine = regexp.MustCompile(`^(# (HELP|TYPE) [a-z_]+ .+|[a-z_]+(\{([a-z_]+="([^"\\]|\\.)*",?)+\})? ([0-9.e+-]+|\+Inf|NaN))$`)
+
+func TestHandleMetrics(t *testing.T) {
+	controlRegistry = NewControlRegistry()
+	for _, ctl := range []*Control{
+		newTestControl("a", "110000", 0, 0),
+		newTestControl("b", "110000", 0, 0),
+		newTestControl("c", "310000", 0, 0),
+	} {
+		controlRegistry.Add(ctl.id, ctl)
+	}
+	controlRegistry.Get("a").bytesIn = 100
+	socksFailed.Inc(socksFailAuth)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !metricLine.MatchString(line) {
+			t.Errorf("invalid line %q", line)
+		}
+	}
+	for _, want := range []string{
+		`dproxy_controls{city="110000"} 2`,
+		`dproxy_controls{city="310000"} 1`,
+		`dproxy_socks_connections_failed_total{reason="auth"} 1`,
+		`dproxy_relayed_bytes_total{client_id="a",city="110000",direction="in"} 100`,
+		`dproxy_active_connections{client_id="c",city="310000"} 0`,
+		`dproxy_get_proxy_seconds_bucket{le="+Inf"} `,
+	} {
+		if !strings.Contains(body, want+"\n") && !strings.Contains(body, "\n"+want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
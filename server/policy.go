@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/snaigle/dproxy/util"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// actions of policy rules
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// PolicyRule allows or denies connections to destinations. Its conditions
+// that are set must all match; empty ones match everything.
+type PolicyRule struct {
+	Action string `json:"action"`
+
+	// proxy users by account name or username, see limitUser
+	Users []string `json:"users,omitempty"`
+
+	// cities of the clients the connections go through
+	Cities []string `json:"cities,omitempty"`
+
+	// targets as CIDRs, IPs or host name globs like "*.example.com". Host
+	// names aren't resolved on the server, networks only match targets
+	// given as IPs; the clients check what names resolve to.
+	Dests []string `json:"dests,omitempty"`
+
+	// target ports and ranges like "8000-8999"
+	Ports []string `json:"ports,omitempty"`
+
+	dests util.DestList
+	ports []util.PortRange
+}
+
+func (r *PolicyRule) matches(user, city, host, addr string) bool {
+	return (len(r.Users) == 0 || containsString(r.Users, user)) &&
+		(len(r.Cities) == 0 || containsString(r.Cities, city)) &&
+		(r.dests.Empty() || r.dests.Match(host)) &&
+		(len(r.ports) == 0 || util.MatchPort(r.ports, addr))
+}
+
+// DestPolicy holds the rules of a json file, a list of PolicyRule. The
+// first rule matching a connection decides, connections no rule matches
+// are allowed. The file is reloaded when its modification time changes,
+// which is checked at most once a second as udp datagrams are checked
+// one by one.
+type DestPolicy struct {
+	// unix second of the last check, accessed atomically and kept first
+	// for 64 bit alignment
+	checked int64
+
+	path    string
+	modTime time.Time
+	rules   []*PolicyRule
+	sync.RWMutex
+}
+
+func NewDestPolicy(path string) (*DestPolicy, error) {
+	p := &DestPolicy{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *DestPolicy) reload() error {
+	now := time.Now().Unix()
+	if checked := atomic.LoadInt64(&p.checked); checked == now || !atomic.CompareAndSwapInt64(&p.checked, checked, now) {
+		return nil
+	}
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	p.RLock()
+	unchanged := fi.ModTime().Equal(p.modTime)
+	p.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var rules []*PolicyRule
+	if err = json.Unmarshal(b, &rules); err != nil {
+		return fmt.Errorf("invalid policy file %s: %v", p.path, err)
+	}
+	for i, r := range rules {
+		if r.Action != policyAllow && r.Action != policyDeny {
+			return fmt.Errorf("rule %d in %s: unknown action %q", i+1, p.path, r.Action)
+		}
+		if r.dests, err = util.ParseDestList(r.Dests); err != nil {
+			return fmt.Errorf("rule %d in %s: %v", i+1, p.path, err)
+		}
+		if r.ports, err = util.ParsePortRanges(r.Ports); err != nil {
+			return fmt.Errorf("rule %d in %s: %v", i+1, p.path, err)
+		}
+	}
+
+	p.Lock()
+	p.rules = rules
+	p.modTime = fi.ModTime()
+	p.Unlock()
+	log.Printf("loaded %d policy rules from %s\n", len(rules), p.path)
+	return nil
+}
+
+// Allows reports whether user may connect to the host:port addr through a
+// client in city.
+func (p *DestPolicy) Allows(user, city, addr string) bool {
+	if err := p.reload(); err != nil {
+		// keep serving with the rules we already have
+		log.Println("failed to reload policy file:", err)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	p.RLock()
+	defer p.RUnlock()
+	for _, r := range p.rules {
+		if r.matches(user, city, host, addr) {
+			return r.Action == policyAllow
+		}
+	}
+	return true
+}
+
+// allowDest reports whether a user may connect to addr through ctl, by
+// the ports of the user account and the rules of the policy file.
+func allowDest(user string, route *Route, ctl *Control, addr string) bool {
+	if !route.allowsAddr(addr) {
+		return false
+	}
+	return destPolicy == nil || destPolicy.Allows(limitUser(user, route), ctl.auth.CityCode, addr)
+}
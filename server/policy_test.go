@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/util"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writePolicy(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDestPolicy(t *testing.T) {
+	p, err := NewDestPolicy(writePolicy(t, `[
+		{"action": "allow", "users": ["admin"]},
+		{"action": "deny", "dests": ["10.0.0.0/8", "192.168.0.0/16", "127.0.0.0/8", "::1", "fc00::/7"]},
+		{"action": "deny", "dests": ["*.internal", "metadata.google.internal"]},
+		{"action": "allow", "users": ["mailer"], "ports": ["25", "587"]},
+		{"action": "deny", "ports": ["25"]},
+		{"action": "deny", "cities": ["310000"], "dests": ["2001:db8::/32"]},
+		{"action": "deny", "users": ["guest"], "ports": ["1-79", "81-442", "444-65535"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, city, addr string
+		want             bool
+	}{
+		{"alice", "110000", "93.184.216.34:443", true},
+		{"alice", "110000", "example.com:80", true},
+		{"alice", "110000", "10.1.2.3:80", false},
+		{"alice", "110000", "192.168.1.1:8080", false},
+		{"alice", "110000", "127.0.0.1:22", false},
+		{"alice", "110000", "[::1]:22", false},
+		{"alice", "110000", "[fd12::1]:80", false},
+		{"alice", "110000", "[2606:2800:220:1::1]:443", true},
+		// host names aren't resolved on the server
+		{"alice", "110000", "localhost:22", true},
+		{"alice", "110000", "db.internal:5432", false},
+		{"alice", "110000", "DB.Internal.:5432", false},
+		{"alice", "110000", "internal:80", true},
+		// the first matching rule decides
+		{"admin", "110000", "10.1.2.3:80", true},
+		{"mailer", "110000", "93.184.216.34:25", true},
+		{"mailer", "110000", "10.1.2.3:25", false},
+		{"alice", "110000", "93.184.216.34:25", false},
+		// all conditions of a rule must match
+		{"alice", "310000", "[2001:db8::1]:80", false},
+		{"alice", "110000", "[2001:db8::1]:80", true},
+		{"guest", "110000", "93.184.216.34:443", true},
+		{"guest", "110000", "93.184.216.34:8443", false},
+		{"alice", "110000", "no-port", false},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(tt.user, tt.city, tt.addr); got != tt.want {
+			t.Errorf("Allows(%s, %s, %s) = %v, want %v", tt.user, tt.city, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDestPolicyInvalid(t *testing.T) {
+	tests := []string{
+		`{"action": "deny"}`,
+		`[{"action": "block"}]`,
+		`[{"action": "deny", "dests": ["10.0.0.0/40"]}]`,
+		`[{"action": "deny", "dests": ["[a-"]}]`,
+		`[{"action": "deny", "ports": ["70000"]}]`,
+	}
+	for _, rules := range tests {
+		if _, err := NewDestPolicy(writePolicy(t, rules)); err == nil {
+			t.Errorf("loaded the policy %s", rules)
+		}
+	}
+}
+
+func TestAllowDest(t *testing.T) {
+	var err error
+	if destPolicy, err = NewDestPolicy(writePolicy(t, `[{"action": "deny", "cities": ["310000"], "ports": ["22"]}]`)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { destPolicy = nil }()
+	ports, _ := util.ParsePortRanges([]string{"22", "443"})
+	user := &ProxyUser{Name: "alice", ports: ports}
+	bj := newTestControl("bj", "110000", 0, 0)
+	sh := newTestControl("sh", "310000", 0, 0)
+	tests := []struct {
+		route *Route
+		ctl   *Control
+		addr  string
+		want  bool
+	}{
+		{&Route{}, bj, "93.184.216.34:22", true},
+		{&Route{}, sh, "93.184.216.34:22", false},
+		{&Route{User: user}, bj, "93.184.216.34:443", true},
+		{&Route{User: user}, bj, "93.184.216.34:80", false},
+		{&Route{User: user}, sh, "93.184.216.34:22", false},
+	}
+	for _, tt := range tests {
+		if got := allowDest("alice", tt.route, tt.ctl, tt.addr); got != tt.want {
+			t.Errorf("allowDest(%s, %s) = %v, want %v", tt.ctl.id, tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const quotaSaveInterval = time.Minute
+
+// quotaUsage counts the bytes a client relayed today and this month, in
+// the local time of the server.
+type quotaUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"dayBytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"monthBytes"`
+	mu         sync.Mutex
+
+	// controls using the usage, guarded by the lock of the tracker
+	refs int
+}
+
+// roll starts new periods once the day or month is over, the caller holds
+// the lock.
+func (q *quotaUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); q.Day != day {
+		q.Day, q.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); q.Month != month {
+		q.Month, q.MonthBytes = month, 0
+	}
+}
+
+func (q *quotaUsage) Add(n int64) {
+	if n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	q.roll(time.Now())
+	q.DayBytes += n
+	q.MonthBytes += n
+	q.mu.Unlock()
+}
+
+// Used returns the bytes relayed today and this month.
+func (q *quotaUsage) Used() (day, month int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(time.Now())
+	return q.DayBytes, q.MonthBytes
+}
+
+// QuotaTracker keeps the usage of clients by client id, so it survives
+// reconnects, and writes it to path every minute and when the server shuts
+// down so it survives restarts. An empty path keeps it in memory only.
+// Usage no control uses is dropped once nothing was relayed in its month.
+type QuotaTracker struct {
+	path  string
+	usage map[string]*quotaUsage
+	sync.Mutex
+}
+
+func LoadQuotaTracker(path string) (*QuotaTracker, error) {
+	t := &QuotaTracker{path: path, usage: make(map[string]*quotaUsage)}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if err == nil {
+			if err = json.Unmarshal(b, &t.usage); err != nil {
+				return nil, fmt.Errorf("invalid quota file %s: %v", path, err)
+			}
+		}
+	}
+	go func() {
+		for range time.Tick(quotaSaveInterval) {
+			t.prune(time.Now())
+			if err := t.Save(); err != nil {
+				log.Println("failed to save quota usage:", err)
+			}
+		}
+	}()
+	return t, nil
+}
+
+// Usage returns the usage of a client, starting it if there is none. The
+// caller releases it once the control of the client goes away.
+func (t *QuotaTracker) Usage(clientId string) *quotaUsage {
+	t.Lock()
+	defer t.Unlock()
+	q, ok := t.usage[clientId]
+	if !ok {
+		q = &quotaUsage{}
+		t.usage[clientId] = q
+	}
+	q.refs++
+	return q
+}
+
+// Release gives back the usage of a client returned by Usage.
+func (t *QuotaTracker) Release(clientId string) {
+	t.Lock()
+	defer t.Unlock()
+	if q, ok := t.usage[clientId]; ok {
+		q.refs--
+		t.drop(clientId, q, time.Now())
+	}
+}
+
+// prune drops the usage of clients that went away before the current
+// periods.
+func (t *QuotaTracker) prune(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for id, q := range t.usage {
+		t.drop(id, q, now)
+	}
+}
+
+// drop removes the usage of a client unless a control uses it or it counts
+// against the quota of this month, the caller holds the lock.
+func (t *QuotaTracker) drop(clientId string, q *quotaUsage, now time.Time) {
+	if q.refs > 0 {
+		return
+	}
+	q.mu.Lock()
+	q.roll(now)
+	used := q.MonthBytes > 0
+	q.mu.Unlock()
+	if !used {
+		delete(t.usage, clientId)
+	}
+}
+
+// Save writes the usage of the current periods, see BanList.save.
+func (t *QuotaTracker) Save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.Lock()
+	usage := make(map[string]*quotaUsage, len(t.usage))
+	now := time.Now()
+	for id, q := range t.usage {
+		q.mu.Lock()
+		q.roll(now)
+		if q.MonthBytes > 0 {
+			usage[id] = &quotaUsage{Day: q.Day, DayBytes: q.DayBytes, Month: q.Month, MonthBytes: q.MonthBytes}
+		}
+		q.mu.Unlock()
+	}
+	t.Unlock()
+
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(t.path), filepath.Base(t.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), t.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaUsageRoll(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		return ts
+	}
+	tests := []struct {
+		name       string
+		then, now  time.Time
+		day, month int64
+	}{
+		{"same day", at("2026-10-17 00:00"), at("2026-10-17 23:59"), 100, 100},
+		{"next day", at("2026-10-17 23:59"), at("2026-10-18 00:00"), 0, 100},
+		{"days later", at("2026-10-01 12:00"), at("2026-10-30 12:00"), 0, 100},
+		{"next month", at("2026-10-31 23:59"), at("2026-11-01 00:00"), 0, 0},
+		{"same day next month", at("2026-10-17 12:00"), at("2026-11-17 12:00"), 0, 0},
+		{"same day next year", at("2026-10-17 12:00"), at("2027-10-17 12:00"), 0, 0},
+	}
+	for _, tt := range tests {
+		q := &quotaUsage{}
+		q.roll(tt.then)
+		q.DayBytes, q.MonthBytes = 100, 100
+		q.roll(tt.now)
+		if q.DayBytes != tt.day || q.MonthBytes != tt.month {
+			t.Errorf("%s: used %d and %d, want %d and %d", tt.name, q.DayBytes, q.MonthBytes, tt.day, tt.month)
+		}
+	}
+}
+
+func TestQuotaTrackerPrune(t *testing.T) {
+	tr, err := LoadQuotaTracker("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Usage("idle")
+	used := tr.Usage("used")
+	used.Add(100)
+	shared := tr.Usage("shared")
+	if tr.Usage("shared") != shared {
+		t.Fatal("a reconnecting client got new usage")
+	}
+	tr.Release("idle")
+	tr.Release("used")
+	tr.Release("shared")
+	if _, ok := tr.usage["idle"]; ok {
+		t.Error("kept the usage of a client without traffic")
+	}
+	if tr.Usage("used") != used {
+		t.Error("dropped the usage of a client within its month")
+	}
+	tr.Release("used")
+	if _, ok := tr.usage["shared"]; !ok {
+		t.Error("dropped the usage of a client that is still connected")
+	}
+
+	tr.prune(time.Now().AddDate(0, 1, 0))
+	if _, ok := tr.usage["used"]; ok {
+		t.Error("kept the usage of a client after its month")
+	}
+	if _, ok := tr.usage["shared"]; !ok {
+		t.Error("dropped the usage of a client that is still connected")
+	}
+}
+
+func TestSelectControlSkipsOverQuota(t *testing.T) {
+	controlRegistry = NewControlRegistry()
+	sessionTable = NewSessionTable(time.Minute)
+	selector = &RoundRobinSelector{}
+	daily := newTestControl("daily", "110000", 39.9, 116.4)
+	daily.auth.DailyQuota = 100
+	monthly := newTestControl("monthly", "110000", 39.9, 116.4)
+	monthly.auth.MonthlyQuota = 100
+	for _, ctl := range []*Control{daily, monthly} {
+		controlRegistry.Add(ctl.id, ctl)
+	}
+
+	daily.quota.Add(100)
+	for i := 0; i < 3; i++ {
+		if ctl, err := selectControl(&Route{City: "110000"}); ctl != monthly {
+			t.Fatalf("picked %v, %v, want the client within its quota", ctl, err)
+		}
+	}
+	if _, err := selectControl(&Route{ClientId: "daily"}); err != errNoControl {
+		t.Fatalf("picked a client over its quota by id: %v", err)
+	}
+	monthly.quota.Add(99)
+	if ctl, _ := selectControl(&Route{Geo: true, Lat: 39.9, Lng: 116.4}); ctl != monthly {
+		t.Fatalf("picked %v, want the client within its quota", ctl)
+	}
+	monthly.quota.Add(1)
+	if _, err := selectControl(&Route{City: "110000"}); err != errNoControl {
+		t.Fatalf("picked a client over its quota: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/util"
+	"sync"
+	"time"
+)
+
+const limiterIdleTimeout = 10 * time.Minute
+
+var (
+	globalLimiter  *util.RateLimiter
+	userLimiters   *limiterSet
+	clientLimiters *limiterSet
+)
+
+// limiterSet shares one rate limiter among all connections of a user or
+// client. Limiters idle for a while are dropped so the set doesn't grow
+// with every user that ever connected.
+type limiterSet struct {
+	rate     func(key string) int64
+	limiters map[string]*limiterEntry
+	sync.Mutex
+}
+
+type limiterEntry struct {
+	limiter  *util.RateLimiter
+	lastUsed time.Time
+}
+
+// newLimiterSet limits key to rates[key] bytes per second, or to def if
+// rates has no entry for it; 0 is unlimited.
+func newLimiterSet(def util.ByteSize, rates map[string]util.ByteSize) *limiterSet {
+	s := &limiterSet{
+		rate: func(key string) int64 {
+			if r, ok := rates[key]; ok {
+				return int64(r)
+			}
+			return int64(def)
+		},
+		limiters: make(map[string]*limiterEntry),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.reap()
+		}
+	}()
+	return s
+}
+
+// Get returns the limiter of key, nil if it is unlimited.
+func (s *limiterSet) Get(key string) *util.RateLimiter {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.limiters[key]
+	if !ok {
+		e = &limiterEntry{}
+		if r := s.rate(key); r > 0 {
+			e.limiter = util.NewRateLimiter(r)
+		}
+		s.limiters[key] = e
+	}
+	e.lastUsed = time.Now()
+	return e.limiter
+}
+
+func (s *limiterSet) reap() {
+	s.Lock()
+	defer s.Unlock()
+	for key, e := range s.limiters {
+		// running relays keep using a limiter they got long ago
+		lastUsed := e.lastUsed
+		if e.limiter != nil && e.limiter.LastUsed().After(lastUsed) {
+			lastUsed = e.limiter.LastUsed()
+		}
+		if time.Since(lastUsed) > limiterIdleTimeout {
+			delete(s.limiters, key)
+		}
+	}
+}
+
+func initRateLimits(c *Config) {
+	if c.RateLimit > 0 {
+		globalLimiter = util.NewRateLimiter(int64(c.RateLimit))
+	}
+	userLimiters = newLimiterSet(c.UserRateLimit, c.UserRateLimits)
+	clientLimiters = newLimiterSet(c.ClientRateLimit, c.ClientRateLimits)
+}
+
+// rateLimits returns the limiters a connection of user through ctl is
+// subject to. Connections of long running relays keep the limiters they
+// started with.
+func rateLimits(user string, ctl *Control) (limits []*util.RateLimiter) {
+	for _, l := range []*util.RateLimiter{globalLimiter, userLimiters.Get(user), clientLimiters.Get(ctl.id)} {
+		if l != nil {
+			limits = append(limits, l)
+		}
+	}
+	return
+}
+
+// limitUser is the name a proxy user is rate and connection limited by:
+// the account of its route, or the whole username if it has none.
+func limitUser(username string, r *Route) string {
+	if r.Account != "" {
+		return r.Account
+	}
+	return username
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"sort"
 	"sync"
 )
 
 // ControlRegistry maps a client ID to Control structures
 type ControlRegistry struct {
 	controls map[string]*Control
+	geo      *GeoIndex
 	sync.RWMutex
 }
 
 func NewControlRegistry() *ControlRegistry {
 	return &ControlRegistry{
 		controls: make(map[string]*Control),
+		geo:      NewGeoIndex(),
 	}
 }
 
@@ -27,8 +30,13 @@ func (r *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
 	defer r.Unlock()
 
 	oldCtl = r.controls[clientId]
+	if oldCtl != nil {
+		oldCtl.Replaced(ctl)
+		r.geo.Remove(oldCtl)
+	}
 
 	r.controls[clientId] = ctl
+	r.geo.Add(ctl)
 	return
 }
 
@@ -43,10 +51,43 @@ func (r *ControlRegistry) Foreach(f func(*Control) bool) {
 
 }
 
-func (r *ControlRegistry) Del(clientId string) {
+// Filter returns the controls for which f returns true, ordered by client
+// id.
+func (r *ControlRegistry) Filter(f func(*Control) bool) []*Control {
+	r.RLock()
+	defer r.RUnlock()
+	var controls []*Control
+	for _, v := range r.controls {
+		if f(v) {
+			controls = append(controls, v)
+		}
+	}
+	sort.Slice(controls, func(i, j int) bool { return controls[i].id < controls[j].id })
+	return controls
+}
+
+// Within returns the controls accepted by f within radius km of lat/lng,
+// nearest first.
+func (r *ControlRegistry) Within(lat, lng, radius float64, f func(*Control) bool) []GeoMatch {
+	r.RLock()
+	defer r.RUnlock()
+	return r.geo.Within(lat, lng, radius, f)
+}
+
+// Nearest returns up to n controls accepted by f, nearest to lat/lng first.
+func (r *ControlRegistry) Nearest(lat, lng float64, n int, f func(*Control) bool) []GeoMatch {
+	r.RLock()
+	defer r.RUnlock()
+	return r.geo.Nearest(lat, lng, n, f)
+}
+
+// Del removes clientId from the registry if it still maps to ctl, so a
+// control that was replaced doesn't remove its replacement.
+func (r *ControlRegistry) Del(clientId string, ctl *Control) {
 	r.Lock()
 	defer r.Unlock()
-	if r.controls[clientId] != nil {
+	if r.controls[clientId] == ctl {
 		delete(r.controls, clientId)
+		r.geo.Remove(ctl)
 	}
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNoControl = errors.New("no proxy available for route")
+)
+
+// Route describes which exit node a proxy user wants. It is parsed from
+// the proxy credentials, so users don't have to look up a client id first.
+type Route struct {
+	Account  string // the part of the username in front of the routing keys
+	ClientId string // a specific client
+	City     string // any client in this city
+	Session  string // keeps the same client for the same session
+
+	// a client near Lat/Lng, within Radius km if it is set and the
+	// nearest one otherwise
+	Geo      bool
+	Lat, Lng float64
+	Radius   float64
+
+	// the authenticated user, see proxyRoute
+	User *ProxyUser
+}
+
+// parseRoute parses proxy credentials. The username is an optional account
+// name followed by dash separated key-value pairs, e.g. "city-110000",
+// "city-110000-session-abc" or "alice-city-110000". The keys are:
+//
+//	id       a client id
+//	city     a city code
+//	session  a session id
+//	lat/lng  a position, selects the nearest client
+//	radius   only clients within this many km of lat/lng
+//
+// Negative numbers keep their sign, "lat--33.87-lng-151.21". Without any
+// routing keys in the username the password is taken as the client id,
+// which is what older users send.
+func parseRoute(username, password string) (*Route, error) {
+	r := &Route{}
+	tokens := strings.Split(username, "-")
+	i := 0
+	// everything in front of the first key is the account name
+	for i < len(tokens) && !isRouteKey(tokens[i]) {
+		i++
+	}
+	r.Account = strings.Join(tokens[:i], "-")
+	if i == len(tokens) {
+		r.ClientId = password
+		return r, nil
+	}
+
+	var hasLat, hasLng bool
+	for i < len(tokens) {
+		key := tokens[i]
+		var value string
+		if i+1 < len(tokens) {
+			value = tokens[i+1]
+		}
+		i += 2
+		// an empty token is the minus sign of a negative number
+		if value == "" && i < len(tokens) {
+			value = "-" + tokens[i]
+			i++
+		}
+		if value == "" {
+			return nil, fmt.Errorf("routing key %q without value", key)
+		}
+
+		var err error
+		switch key {
+		case "id":
+			r.ClientId = value
+		case "city":
+			r.City = value
+		case "session":
+			r.Session = value
+		case "lat":
+			r.Lat, err = strconv.ParseFloat(value, 64)
+			hasLat = err == nil && r.Lat >= -90 && r.Lat <= 90
+		case "lng":
+			r.Lng, err = strconv.ParseFloat(value, 64)
+			hasLng = err == nil && r.Lng >= -180 && r.Lng <= 180
+		case "radius":
+			r.Radius, err = strconv.ParseFloat(value, 64)
+			if err == nil && r.Radius <= 0 {
+				err = errors.New("must be positive")
+			}
+		default:
+			return nil, fmt.Errorf("unknown routing key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+	}
+	if hasLat != hasLng || (r.Radius > 0 && !hasLat) {
+		return nil, errors.New("lat and lng must be given together and within range")
+	}
+	r.Geo = hasLat
+	return r, nil
+}
+
+func isRouteKey(s string) bool {
+	switch s {
+	case "id", "city", "session", "lat", "lng", "radius":
+		return true
+	}
+	return false
+}
+
+// target describes which clients the route accepts, leaving out the
+// session.
+func (r *Route) target() string {
+	var parts []string
+	if r.ClientId != "" {
+		parts = append(parts, "id="+r.ClientId)
+	}
+	if r.City != "" {
+		parts = append(parts, "city="+r.City)
+	}
+	if r.Geo {
+		parts = append(parts, fmt.Sprintf("lat=%g,lng=%g", r.Lat, r.Lng))
+		if r.Radius > 0 {
+			parts = append(parts, fmt.Sprintf("radius=%g", r.Radius))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *Route) String() string {
+	if r.Session != "" {
+		return r.target() + ",session=" + r.Session
+	}
+	return r.target()
+}
+
+// selectControl picks the control which serves route. Routes with a
+// session stick to the same client, see SessionTable.
+func selectControl(r *Route) (*Control, error) {
+	if r.ClientId != "" {
+		ctl := controlRegistry.Get(r.ClientId)
+		if ctl == nil || !ctl.Available() || !r.allows(ctl) {
+			return nil, errNoControl
+		}
+		return ctl, nil
+	}
+	if r.City == "" && !r.Geo && r.User == nil {
+		return nil, errNoControl
+	}
+	pick := func() (*Control, error) { return pickControl(r) }
+	if r.Session == "" {
+		return pick()
+	}
+	return sessionTable.Lookup(r.Account+"/"+r.Session, r.target(), r.allows, pick)
+}
+
+// pickControl picks one of the controls matching the city and position of
+// route. Controls with free connection slots are preferred, only when all
+// of them are full the connection queues for one.
+func pickControl(r *Route) (*Control, error) {
+	if ctl, err := pickControlWith(r, func(ctl *Control) bool { return !ctl.streams.full() }); err == nil {
+		return ctl, nil
+	}
+	return pickControlWith(r, func(*Control) bool { return true })
+}
+
+func pickControlWith(r *Route, f func(*Control) bool) (*Control, error) {
+	accept := func(ctl *Control) bool {
+		return ctl.Available() && (r.City == "" || ctl.auth.CityCode == r.City) && r.allows(ctl) && f(ctl)
+	}
+	var candidates []*Control
+	switch {
+	case r.Geo && r.Radius > 0:
+		for _, m := range controlRegistry.Within(r.Lat, r.Lng, r.Radius, accept) {
+			candidates = append(candidates, m.Control)
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+	case r.Geo:
+		if matches := controlRegistry.Nearest(r.Lat, r.Lng, 1, accept); len(matches) > 0 {
+			return matches[0].Control, nil
+		}
+	default:
+		candidates = controlRegistry.Filter(accept)
+	}
+	if len(candidates) == 0 {
+		return nil, errNoControl
+	}
+	return selector.Select(candidates), nil
+}
+
+// allows reports whether the user of the route may use ctl.
+func (r *Route) allows(ctl *Control) bool {
+	return r.User == nil || r.User.AllowsCity(ctl.auth.CityCode)
+}
+
+// allowsAddr reports whether the user of the route may connect to addr.
+func (r *Route) allowsAddr(addr string) bool {
+	return r.User == nil || r.User.AllowsAddr(addr)
+}
+
+// routeControl selects the control for route and logs the choice.
+func routeControl(r *Route) (*Control, error) {
+	ctl, err := selectControl(r)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("route %s to client %s\n", r, ctl.id)
+	return ctl, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/msg"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestControl(id, city string, lat, lng float64) *Control {
+	return &Control{
+		id:    id,
+		auth:  &msg.Auth{CityCode: city, GpsLat: lat, GpsLit: lng},
+		quota: &quotaUsage{},
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		username, password string
+		want               *Route
+	}{
+		// without routing keys the password is the client id
+		{"", "84e6f3dd352c8d8d", &Route{ClientId: "84e6f3dd352c8d8d"}},
+		{"alice", "84e6f3dd352c8d8d", &Route{Account: "alice", ClientId: "84e6f3dd352c8d8d"}},
+		{"id-84e6f3dd352c8d8d", "x", &Route{ClientId: "84e6f3dd352c8d8d"}},
+		{"city-110000", "x", &Route{City: "110000"}},
+		{"city-110000-session-abc", "x", &Route{City: "110000", Session: "abc"}},
+		{"session-abc-city-110000", "x", &Route{City: "110000", Session: "abc"}},
+		{"alice-city-110000", "x", &Route{Account: "alice", City: "110000"}},
+		{"my-team-city-110000-session-1", "x", &Route{Account: "my-team", City: "110000", Session: "1"}},
+		{"lat-39.9-lng-116.4", "x", &Route{Geo: true, Lat: 39.9, Lng: 116.4}},
+		{"lat-39.9-lng-116.4-radius-50", "x", &Route{Geo: true, Lat: 39.9, Lng: 116.4, Radius: 50}},
+		{"lat--33.87-lng-151.21", "x", &Route{Geo: true, Lat: -33.87, Lng: 151.21}},
+		{"lat--33.45-lng--70.66-radius-2.5", "x", &Route{Geo: true, Lat: -33.45, Lng: -70.66, Radius: 2.5}},
+		{"alice-city-310000-lat-31.2-lng-121.5", "x", &Route{Account: "alice", City: "310000", Geo: true, Lat: 31.2, Lng: 121.5}},
+		{"lat-90-lng--180", "x", &Route{Geo: true, Lat: 90, Lng: -180}},
+	}
+	for _, tt := range tests {
+		got, err := parseRoute(tt.username, tt.password)
+		if err != nil {
+			t.Errorf("parseRoute(%q) failed: %v", tt.username, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRoute(%q) = %+v, want %+v", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	tests := []string{
+		"city",
+		"alice-city",
+		"city-110000-session",
+		"session-a-b",
+		"city-110000-country-cn",
+		"lat-39.9",
+		"lng-116.4",
+		"radius-10",
+		"radius-10-city-110000",
+		"lat-91-lng-0",
+		"lat-0-lng-180.5",
+		"lat--90.1-lng-0",
+		"lat-abc-lng-116.4",
+		"lat-39.9-lng-116.4-radius-0",
+		"lat-39.9-lng-116.4-radius--5",
+		"lat-39.9-lng-116.4-radius-far",
+	}
+	for _, username := range tests {
+		if r, err := parseRoute(username, "x"); err == nil {
+			t.Errorf("parseRoute(%q) = %+v, want an error", username, r)
+		}
+	}
+}
+
+func TestValidUserName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"alice", true},
+		{"my-team", true},
+		{"", false},
+		{"city", false},
+		{"alice-session", false},
+		{"alice-", false},
+		{"-alice", false},
+	}
+	for _, tt := range tests {
+		if got := validUserName(tt.name); got != tt.want {
+			t.Errorf("validUserName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectControl(t *testing.T) {
+	controlRegistry = NewControlRegistry()
+	sessionTable = NewSessionTable(time.Minute)
+	selector = &RoundRobinSelector{}
+	bj1 := newTestControl("bj1", "110000", 39.9, 116.4)
+	bj2 := newTestControl("bj2", "110000", 39.13, 117.2)
+	sh := newTestControl("sh", "310000", 31.23, 121.47)
+	for _, ctl := range []*Control{bj1, bj2, sh} {
+		controlRegistry.Add(ctl.id, ctl)
+	}
+
+	tests := []struct {
+		route *Route
+		want  []*Control // any of them
+	}{
+		{&Route{ClientId: "sh"}, []*Control{sh}},
+		{&Route{ClientId: "gz"}, nil},
+		{&Route{City: "310000"}, []*Control{sh}},
+		{&Route{City: "110000"}, []*Control{bj1, bj2}},
+		{&Route{City: "440100"}, nil},
+		// nothing selects a client
+		{&Route{Account: "alice"}, nil},
+		{&Route{Geo: true, Lat: 30.27, Lng: 120.15}, []*Control{sh}},
+		{&Route{Geo: true, Lat: 39.5, Lng: 116.8, Radius: 100}, []*Control{bj1, bj2}},
+		{&Route{Geo: true, Lat: 30.27, Lng: 120.15, Radius: 100}, nil},
+		{&Route{City: "110000", Geo: true, Lat: 30.27, Lng: 120.15}, []*Control{bj2}},
+		// users may leave out the city and only get their cities
+		{&Route{User: &ProxyUser{Name: "alice", Cities: []string{"310000"}}}, []*Control{sh}},
+		{&Route{ClientId: "bj1", User: &ProxyUser{Name: "alice", Cities: []string{"310000"}}}, nil},
+	}
+	for _, tt := range tests {
+		got, err := selectControl(tt.route)
+		if tt.want == nil {
+			if err != errNoControl {
+				t.Errorf("route %s got %v, %v, want %v", tt.route, got, err, errNoControl)
+			}
+			continue
+		}
+		if err != nil || !containsControl(tt.want, got) {
+			t.Errorf("route %s got %v, %v", tt.route, got, err)
+		}
+	}
+
+	// a session sticks to its client until it goes away
+	route := &Route{City: "110000", Session: "abc"}
+	first, err := selectControl(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if ctl, _ := selectControl(route); ctl != first {
+			t.Fatalf("session moved from %s to %s", first.id, ctl.id)
+		}
+	}
+	first.SetDraining(true)
+	if ctl, _ := selectControl(route); ctl == nil || ctl == first {
+		t.Fatalf("session stayed on draining client %s", first.id)
+	}
+
+	// and until the user may no longer use it
+	user := &ProxyUser{Name: "bob", Cities: []string{"310000"}}
+	route = &Route{Account: "bob", Session: "s1", User: user}
+	if ctl, _ := selectControl(route); ctl != sh {
+		t.Fatalf("session got client %v, want %s", ctl, sh.id)
+	}
+	user.Cities = []string{"110000"}
+	if ctl, _ := selectControl(route); ctl == nil || ctl == sh {
+		t.Fatalf("session stayed on client %s the user may not use", sh.id)
+	}
+}
+
+func containsControl(controls []*Control, ctl *Control) bool {
+	for _, c := range controls {
+		if c == ctl {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Selector chooses the exit node of a new connection among candidates,
+// which are never empty and ordered by client id.
+type Selector interface {
+	Select(candidates []*Control) *Control
+}
+
+// Names of the load balancing strategies for NewSelector.
+const (
+	BalanceRoundRobin     = "round-robin"
+	BalanceLeastActive    = "least-active"
+	BalanceWeightedRandom = "weighted-random"
+	BalanceLowestRtt      = "lowest-rtt"
+)
+
+func NewSelector(name string) (Selector, error) {
+	switch name {
+	case BalanceRoundRobin:
+		return &RoundRobinSelector{}, nil
+	case BalanceLeastActive:
+		return LeastActiveSelector{}, nil
+	case BalanceWeightedRandom:
+		return &WeightedRandomSelector{}, nil
+	case BalanceLowestRtt:
+		return LowestRttSelector{}, nil
+	}
+	return nil, fmt.Errorf("unknown balance strategy %q", name)
+}
+
+// RoundRobinSelector takes turns among the candidates.
+type RoundRobinSelector struct {
+	next uint64
+}
+
+func (s *RoundRobinSelector) Select(candidates []*Control) *Control {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// LeastActiveSelector picks the candidate with the fewest active
+// connections.
+type LeastActiveSelector struct{}
+
+func (LeastActiveSelector) Select(candidates []*Control) *Control {
+	best := candidates[0]
+	for _, ctl := range candidates[1:] {
+		if ctl.Active() < best.Active() {
+			best = ctl
+		}
+	}
+	return best
+}
+
+// WeightedRandomSelector picks a random candidate, the chance of each is
+// proportional to the weight its client announced. It takes turns if the
+// weights don't add up to something positive.
+type WeightedRandomSelector struct {
+	fallback RoundRobinSelector
+}
+
+func (s *WeightedRandomSelector) Select(candidates []*Control) *Control {
+	var total int64
+	for _, ctl := range candidates {
+		total += int64(ctl.Weight())
+	}
+	if total <= 0 {
+		return s.fallback.Select(candidates)
+	}
+	n := rand.Int63n(total)
+	for _, ctl := range candidates {
+		if n -= int64(ctl.Weight()); n < 0 {
+			return ctl
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// LowestRttSelector picks the candidate whose heartbeat reported the lowest
+// round trip time. Candidates that didn't report one yet come last, ties
+// go to the one with fewer active connections.
+type LowestRttSelector struct{}
+
+func (LowestRttSelector) Select(candidates []*Control) *Control {
+	rtt := func(ctl *Control) int64 {
+		if r := ctl.Rtt(); r > 0 {
+			return r
+		}
+		return math.MaxInt64
+	}
+	best := candidates[0]
+	for _, ctl := range candidates[1:] {
+		if r, b := rtt(ctl), rtt(best); r < b || r == b && ctl.Active() < best.Active() {
+			best = ctl
+		}
+	}
+	return best
+}
+
+var errOverQuota = errors.New("client is over its quota")
+
+// activeConn counts as an active connection of its control until it is
+// closed and counts the bytes relayed over it, also against the quotas of
+// the client. It fails once the client is over a quota, so long running
+// relays end there too.
+type activeConn struct {
+	net.Conn
+	ctl  *Control
+	once sync.Once
+}
+
+func (c *activeConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.ctl.bytesIn, int64(n))
+	c.ctl.quota.Add(int64(n))
+	if err == nil && c.ctl.OverQuota() {
+		err = errOverQuota
+	}
+	return
+}
+
+func (c *activeConn) Write(b []byte) (n int, err error) {
+	if c.ctl.OverQuota() {
+		return 0, errOverQuota
+	}
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.ctl.bytesOut, int64(n))
+	c.ctl.quota.Add(int64(n))
+	return
+}
+
+func (c *activeConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.ctl.active, -1) })
+	return c.Conn.Close()
+}
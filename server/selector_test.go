@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWeightedRandomSelector(t *testing.T) {
+	light := newTestControl("light", "110000", 0, 0)
+	heavy := newTestControl("heavy", "110000", 0, 0)
+	heavy.auth.Weight = 3
+	s := &WeightedRandomSelector{}
+	picks := map[*Control]int{}
+	for i := 0; i < 4000; i++ {
+		picks[s.Select([]*Control{light, heavy})]++
+	}
+	if picks[heavy] < 2700 || picks[heavy] > 3300 {
+		t.Errorf("picked the client with weight 3 %d times out of 4000", picks[heavy])
+	}
+
+	// weights that overflow the sum fall back to taking turns
+	light.auth.Weight, heavy.auth.Weight = math.MaxInt, math.MaxInt
+	for i, want := range []*Control{light, heavy, light} {
+		if got := s.Select([]*Control{light, heavy}); got != want {
+			t.Errorf("pick %d went to %s, want %s", i, got.id, want.id)
+		}
+	}
+}
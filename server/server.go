@@ -1,17 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/snaigle/dproxy/msg"
-	"github.com/snaigle/dproxy/util"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -27,22 +31,116 @@ var (
 )
 
 var (
+	opts            *Config
 	controlRegistry *ControlRegistry
+	sessionTable    *SessionTable
+	selector        Selector
+	banList         *BanList
+	userStore       *UserStore
+	destPolicy      *DestPolicy
+	quotaTracker    *QuotaTracker
+	usageSink       UsageSink
+	authenticator   Authenticator
 )
 
 const (
-	socksVer5                       = 5
-	socksCmdConnect                 = 1
-	socksAuthNone                   = 0
-	socksAuthUserName               = 2
-	connReadTimeout   time.Duration = 10 * time.Second
+	socksVer5            = 5
+	socksCmdConnect      = 1
+	socksCmdBind         = 2
+	socksCmdUdpAssociate = 3
+	socksAuthNone        = 0
+	socksAuthUserName    = 2
 )
 
 func main() {
+	var (
+		cmd *commandFlags
+		err error
+	)
+	if opts, cmd, err = loadConfig(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if cmd.printConfig {
+		opts.print()
+		return
+	}
+	if err = opts.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if cmd.hashPass != "" {
+		hash, err := hashPassword(cmd.hashPass)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	var auths MultiAuthenticator
+	if opts.AuthTokenFile != "" {
+		a, err := NewTokenFileAuthenticator(opts.AuthTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auths = append(auths, a)
+	}
+	if opts.AuthHMACSecret != "" {
+		a := NewHMACAuthenticator(opts.AuthHMACSecret)
+		if cmd.genToken != "" {
+			fmt.Println(a.Token(cmd.genToken, time.Now().Add(cmd.genTokenTTL)))
+			return
+		}
+		auths = append(auths, a)
+	} else if cmd.genToken != "" {
+		log.Fatal("-gen-token requires -auth-hmac-secret")
+	}
+	if len(auths) > 0 {
+		authenticator = auths
+	} else {
+		log.Println("no authenticator configured, accepting any client token")
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLSCert != "" {
+		if tlsConfig, err = loadTLSConfig(opts.TLSCert, opts.TLSKey, opts.TLSClientCA); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.Println("server starting")
+	if usageSink, err = newUsageSink(opts); err != nil {
+		log.Fatal(err)
+	}
+	if banList, err = LoadBanList(opts.BanFile); err != nil {
+		log.Fatal(err)
+	}
+	if opts.UserFile != "" {
+		if userStore, err = NewUserStore(opts.UserFile); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("no user file configured, accepting any proxy credentials")
+	}
+	if opts.PolicyFile != "" {
+		if destPolicy, err = NewDestPolicy(opts.PolicyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if quotaTracker, err = LoadQuotaTracker(opts.QuotaFile); err != nil {
+		log.Fatal(err)
+	}
+	if selector, err = NewSelector(opts.Balance); err != nil {
+		log.Fatal(err)
+	}
+	initRateLimits(opts)
+	initConnLimits(opts)
 	controlRegistry = NewControlRegistry()
-	go listenTunnel("127.0.0.1:1091")
-	go listenSocks("127.0.0.1:1090")
+	sessionTable = NewSessionTable(time.Duration(opts.SessionTTL))
+	go listenTunnel(opts.TunnelAddr, tlsConfig)
+	go listenSocks(opts.SocksAddr)
+	if opts.HttpProxyAddr != "" {
+		go listenHttpProxy(opts.HttpProxyAddr)
+	}
 	http.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -52,24 +150,34 @@ func main() {
 		}()
 		cityCode := req.URL.Query().Get("cityCode")
 		if cityCode == "" {
-			renderJson(&resp, 200, map[string]interface{}{"success": true, "message": "城市为空"})
+			renderJson(&resp, 200, map[string]interface{}{"success": false, "message": "城市为空"})
+		} else if ctl, err := pickControl(&Route{City: cityCode}); err == nil {
+			renderJson(&resp, 200, map[string]interface{}{"success": true, "data": ctl.id})
 		} else {
-			var clientId string
-			controlRegistry.Foreach(func(control *Control) bool {
-				if control.auth.CityCode == cityCode {
-					clientId = control.id
-					return true
-				}
-				return false
-			})
-			if clientId == "" {
-				renderJson(&resp, 200, map[string]interface{}{"success": true, "data": clientId})
-			} else {
-				renderJson(&resp, 200, map[string]interface{}{"success": false, "message": "not has proxy of city"})
-			}
+			renderJson(&resp, 200, map[string]interface{}{"success": false, "message": "not has proxy of city"})
 		}
 	})
-	http.ListenAndServe("127.0.0.1:9090", nil)
+	go handleSignals()
+	registerApi(http.DefaultServeMux)
+	http.HandleFunc("/metrics", handleMetrics)
+	log.Fatal(http.ListenAndServe(opts.HttpAddr, nil))
+}
+
+// handleSignals saves what would be lost when the server is stopped with
+// SIGINT or SIGTERM, then exits.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	log.Println("shutting down on", <-c)
+	if usageSink != nil {
+		if err := usageSink.Close(); err != nil {
+			log.Println("failed to close usage sink:", err)
+		}
+	}
+	if err := quotaTracker.Save(); err != nil {
+		log.Println("failed to save quota usage:", err)
+	}
+	os.Exit(0)
 }
 
 func renderJson(resp *http.ResponseWriter, code int, data interface{}) {
@@ -82,11 +190,14 @@ func renderJson(resp *http.ResponseWriter, code int, data interface{}) {
 	(*resp).Write(b)
 }
 
-func listenTunnel(listenAddr string) {
+func listenTunnel(listenAddr string, tlsConfig *tls.Config) {
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
 	log.Println("listen proxy connection")
 	for {
 		conn, err := ln.Accept()
@@ -110,6 +221,7 @@ func listenSocks(listenAddr string) {
 			log.Println("accept:", err)
 			continue
 		}
+		socksAccepted.Inc()
 		go handleSocks5Connection(conn)
 	}
 }
@@ -121,40 +233,95 @@ func handleSocks5Connection(conn net.Conn) {
 			conn.Close()
 		}
 	}()
-	clientId, err := handshake(conn)
+	username, password, err := handshake(conn)
 	if err != nil {
 		log.Println("socks handshake:", err)
+		socksFailed.Inc(socksFailHandshake)
+		return
+	}
+	var ctl *Control
+	route, err := proxyRoute(username, password)
+	if err == errProxyAuth || err == errUserExpired {
+		log.Printf("rejected user %q: %v\n", username, err)
+		socksFailed.Inc(socksFailAuth)
+		conn.Write([]byte{socksAuthVer, socksAuthFailure})
+		return
+	}
+	if err == nil {
+		ctl, err = routeControl(route)
+	}
+	if err != nil {
+		log.Printf("no proxy for user %q: %v\n", username, err)
+		socksFailed.Inc(socksFailNoRoute)
+		conn.Write([]byte{socksAuthVer, socksAuthFailure})
+		return
+	}
+	if _, err = conn.Write([]byte{socksAuthVer, socksAuthSuccess}); err != nil {
 		return
 	}
 
-	rawaddr, addr, err := getRequest(conn)
+	cmd, _, addr, err := getRequest(conn)
 	if err != nil {
 		log.Println("error getting request:", err)
+		socksFailed.Inc(socksFailRequest)
+		if err == errCmd {
+			writeSocksReply(conn, socksRepCmdNotSupported, "")
+		}
 		return
 	}
-	log.Println("accept request:", addr)
-	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+	// the address of an udp associate is where the socks client sends
+	// from, its datagrams are checked one by one
+	if cmd != socksCmdUdpAssociate && !allowDest(username, route, ctl, addr) {
+		log.Printf("rejected request of user %q to %s: %v\n", username, addr, errDestNotAllowed)
+		socksFailed.Inc(socksFailNotAllowed)
+		writeSocksReply(conn, socksRepNotAllowed, "")
+		return
+	}
+	release, err := acquireConn(limitUser(username, route), ctl)
 	if err != nil {
-		log.Println("send connection confirmation:", err)
+		log.Printf("rejected request of user %q to client %s: %v\n", username, ctl.id, err)
+		socksFailed.Inc(socksFailConnLimit)
+		// not allowed is the answer of the policy, this is about capacity
+		writeSocksReply(conn, socksRepGeneralFailure, "")
 		return
 	}
-	proxy, err := getProxyConn(rawaddr, addr, clientId)
+	defer release()
+	switch cmd {
+	case socksCmdUdpAssociate:
+		handleUdpAssociate(conn, route, ctl, newUsage(username, route, ctl, usageSocksUdp, ""))
+		return
+	case socksCmdBind:
+		handleBind(conn, route, ctl, addr, newUsage(username, route, ctl, usageSocksBind, addr))
+		return
+	}
+	u := newUsage(username, route, ctl, usageSocks, addr)
+	log.Println("accept request:", addr)
+	proxy, result, err := getProxyConn(ctl, addr)
 	if err != nil {
 		log.Println("failed get proxy connection:", err)
+		socksFailed.Inc(failReason(err))
+		writeSocksReply(conn, socksReplyCode(err), "")
 		return
 	}
+	u.connected(result)
 	defer func() {
 		if !closed {
 			proxy.Close()
 		}
 	}()
-	go util.PipeThenClose(conn, proxy)
-	util.PipeThenClose(proxy, conn)
+	if err = writeSocksReply(conn, socksRepSucceeded, result.Addr); err != nil {
+		log.Println("send connection confirmation:", err)
+		return
+	}
+	relay(conn, proxy, u)
 	closed = true
 	log.Println("closed connection to", addr)
 }
 
-func handshake(conn net.Conn) (clientId string, err error) {
+// handshake negotiates username/password authentication and returns the
+// credentials. The caller sends the auth status once it knows whether they
+// select a client.
+func handshake(conn net.Conn) (username, password string, err error) {
 	const (
 		idVer     = 0
 		idNmethod = 1
@@ -184,16 +351,11 @@ func handshake(conn net.Conn) (clientId string, err error) {
 	// no authentication required
 	// 必须支持username password auth
 	_, err = conn.Write([]byte{socksVer5, socksAuthUserName})
-	authBuf := make([]byte, 67) // username 和password最长为32
+	authBuf := make([]byte, 513) // username 和password最长为255
 	if n, err = io.ReadAtLeast(conn, authBuf, 2); err != nil {
 		return
 	}
-	fmt.Println("auth version:", authBuf[0])
 	userNameLength := int(authBuf[1])
-	if userNameLength >= 32 {
-		err = errAuthLengthError
-		return
-	}
 	var p int
 	if n < userNameLength+2 {
 		if p, err = io.ReadAtLeast(conn, authBuf[n:], userNameLength+2-n); err != nil {
@@ -201,7 +363,6 @@ func handshake(conn net.Conn) (clientId string, err error) {
 		}
 	}
 	userName := string(authBuf[2 : userNameLength+2])
-	log.Println("auth userName:", userName)
 	var pl int
 	if n+p == userNameLength+2 {
 		if pl, err = io.ReadAtLeast(conn, authBuf[userNameLength+2:], 1); err != nil {
@@ -214,14 +375,12 @@ func handshake(conn net.Conn) (clientId string, err error) {
 			return
 		}
 	}
-	password := string(authBuf[userNameLength+3 : userNameLength+3+passwordLength])
-	log.Println("auth password:", password)
-	clientId = password
-	_, err = conn.Write([]byte{authBuf[0], 0x00})
+	password = string(authBuf[userNameLength+3 : userNameLength+3+passwordLength])
+	username = userName
 	return
 }
 
-func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
+func getRequest(conn net.Conn) (cmd byte, rawaddr []byte, host string, err error) {
 	const (
 		idVer   = 0
 		idCmd   = 1
@@ -247,7 +406,8 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 		err = errVer
 		return
 	}
-	if buf[idCmd] != socksCmdConnect {
+	cmd = buf[idCmd]
+	if cmd != socksCmdConnect && cmd != socksCmdBind && cmd != socksCmdUdpAssociate {
 		err = errCmd
 		return
 	}
@@ -273,9 +433,9 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 	rawaddr = buf[idType:reqLen]
 	switch buf[idType] {
 	case typeIPv4:
-		host = net.IP(buf[idIP0:idIP0+net.IPv4len]).String()
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
 	case typeIPv6:
-		host = net.IP(buf[idIP0:idIP0+net.IPv6len]).String()
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
 	case typeDm:
 		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
 	}
@@ -284,28 +444,54 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 	return
 }
 
-func getProxyConn(rawaddr []byte, host string, clientId string) (conn net.Conn, err error) {
-	ctl := controlRegistry.Get(clientId)
-	if ctl == nil {
-		log.Println("control is not found:", clientId)
-		err = errors.New("control is not found")
+// getProxyConn asks the client to connect to host and waits for the result,
+// which has the addresses of the client's connection; a failure reported by
+// the client is returned as a *dialError.
+func getProxyConn(ctl *Control, host string) (conn net.Conn, result msg.DialResult, err error) {
+	if conn, err = startProxyConn(ctl, &msg.StartProxy{ClientAddr: host}); err != nil {
 		return
 	}
-	for i := 0; i < proxyMaxPoolSize; i++ {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(opts.DialTimeout)))
+	err = msg.ReadMsgInto(conn, &result)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = &dialError{Reason: msg.DialErrTimeout, Message: "timeout waiting for dial result"}
+		}
+	} else if result.Error != "" {
+		err = &dialError{Reason: result.Reason, Message: result.Error}
+	}
+	if err != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	return
+}
+
+// startProxyConn gets a proxy connection to the client and sends startMsg,
+// which tells the client what to do with it.
+func startProxyConn(ctl *Control, startMsg msg.Message) (conn net.Conn, err error) {
+	for i := 0; i < opts.ProxyMaxPoolSize; i++ {
+		start := time.Now()
 		conn, err = ctl.GetProxy()
+		getProxySeconds.ObserveSince(start)
 		if err != nil {
 			log.Println("Failed to get proxy connection ", err)
 			return
 		}
-		startProxyMsg := &msg.StartProxy{
-			ClientAddr: host,
-		}
-		if err = msg.WriteMsg(conn, startProxyMsg); err != nil {
+		// pooled connections expire while idle, not once they are in use
+		conn.SetDeadline(time.Time{})
+		if err = msg.WriteMsg(conn, startMsg); err != nil {
 			log.Printf("Failed to write start-proxy-message: %v, attempt %d", err, i)
 			conn.Close()
 		} else {
 			break
 		}
 	}
+	if err == nil {
+		atomic.AddInt64(&ctl.active, 1)
+		conn = &activeConn{Conn: conn, ctl: ctl}
+	}
 	return
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StickySession pins a user supplied session id to a client, so all the
+// connections of the session leave through the same exit node.
+type StickySession struct {
+	Key       string    `json:"key"`
+	Route     string    `json:"route"`
+	ClientId  string    `json:"clientId"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Failovers int       `json:"failovers"`
+}
+
+// SessionTable maps session keys to the clients they are pinned to. A
+// session expires when it isn't used for ttl.
+type SessionTable struct {
+	ttl      time.Duration
+	sessions map[string]*StickySession
+	sync.Mutex
+}
+
+func NewSessionTable(ttl time.Duration) *SessionTable {
+	t := &SessionTable{
+		ttl:      ttl,
+		sessions: make(map[string]*StickySession),
+	}
+	go t.reaper()
+	return t
+}
+
+// Lookup returns the control pinned to key. New sessions, expired ones and
+// those whose client went away, drains, is over its quota or is no longer
+// allowed are pinned to the control returned by pick, which is expected to
+// choose from the clients the route accepts. pick runs without the table
+// lock held.
+func (t *SessionTable) Lookup(key, route string, allow func(*Control) bool, pick func() (*Control, error)) (*Control, error) {
+	ctl, prev := t.pinned(key, route, allow)
+	if ctl != nil {
+		return ctl, nil
+	}
+
+	ctl, err := pick()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	// another connection of the session may have pinned it meanwhile
+	if pinned, _ := t.pinnedLocked(key, route, allow); pinned != nil {
+		return pinned, nil
+	}
+	now := time.Now()
+	s := &StickySession{Key: key, Route: route, ClientId: ctl.id, Created: now, LastUsed: now}
+	if prev != nil {
+		log.Printf("session %s failed over from client %s to %s\n", key, prev.ClientId, ctl.id)
+		s.Created = prev.Created
+		s.Failovers = prev.Failovers + 1
+	}
+	t.sessions[key] = s
+	return ctl, nil
+}
+
+// pinned returns the usable control pinned to key, or the session which
+// lost its client.
+func (t *SessionTable) pinned(key, route string, allow func(*Control) bool) (*Control, *StickySession) {
+	t.Lock()
+	defer t.Unlock()
+	return t.pinnedLocked(key, route, allow)
+}
+
+func (t *SessionTable) pinnedLocked(key, route string, allow func(*Control) bool) (*Control, *StickySession) {
+	now := time.Now()
+	s := t.sessions[key]
+	if s == nil {
+		return nil, nil
+	}
+	if s.Route != route || now.Sub(s.LastUsed) > t.ttl {
+		delete(t.sessions, key)
+		return nil, nil
+	}
+	if ctl := controlRegistry.Get(s.ClientId); ctl != nil && ctl.Available() && allow(ctl) {
+		s.LastUsed = now
+		return ctl, nil
+	}
+	delete(t.sessions, key)
+	copied := *s
+	return nil, &copied
+}
+
+// Sessions returns a copy of the live sessions, ordered by key.
+func (t *SessionTable) Sessions() []StickySession {
+	t.Lock()
+	defer t.Unlock()
+	sessions := make([]StickySession, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Key < sessions[j].Key })
+	return sessions
+}
+
+func (t *SessionTable) reaper() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.Lock()
+		for key, s := range t.sessions {
+			if now.Sub(s.LastUsed) > t.ttl {
+				delete(t.sessions, key)
+			}
+		}
+		t.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/snaigle/dproxy/msg"
+	"net"
+	"strconv"
+)
+
+// socks5 reply codes, RFC 1928 section 6
+const (
+	socksRepSucceeded          = 0x00
+	socksRepGeneralFailure     = 0x01
+	socksRepNotAllowed         = 0x02
+	socksRepNetworkUnreachable = 0x03
+	socksRepHostUnreachable    = 0x04
+	socksRepConnRefused        = 0x05
+	socksRepTTLExpired         = 0x06
+	socksRepCmdNotSupported    = 0x07
+	socksRepAddrNotSupported   = 0x08
+)
+
+// username/password authentication, RFC 1929
+const (
+	socksAuthVer     = 0x01
+	socksAuthSuccess = 0x00
+	socksAuthFailure = 0x01
+)
+
+const (
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+)
+
+var errShortAddr = errors.New("socks address too short")
+
+// dialError is a failure to reach the target, as reported by the client.
+type dialError struct {
+	Reason  string // one of the msg.DialErr* constants
+	Message string
+}
+
+func (e *dialError) Error() string {
+	return "dial failed: " + e.Message
+}
+
+// socksReplyCode maps an error from getProxyConn to a socks5 reply code.
+func socksReplyCode(err error) byte {
+	de, ok := err.(*dialError)
+	if !ok {
+		return socksRepGeneralFailure
+	}
+	switch de.Reason {
+	case msg.DialErrNetworkUnreachable:
+		return socksRepNetworkUnreachable
+	case msg.DialErrHostUnreachable:
+		return socksRepHostUnreachable
+	case msg.DialErrConnRefused:
+		return socksRepConnRefused
+	case msg.DialErrTimeout:
+		return socksRepTTLExpired
+	case msg.DialErrNotAllowed:
+		return socksRepNotAllowed
+	}
+	return socksRepGeneralFailure
+}
+
+// failReason is the metrics label of an error from getProxyConn.
+func failReason(err error) string {
+	if de, ok := err.(*dialError); ok && de.Reason != "" {
+		return de.Reason
+	}
+	return socksFailNoProxy
+}
+
+// writeSocksReply sends a reply with the given code and bound host:port. An
+// empty or unparseable addr is sent as 0.0.0.0:0.
+func writeSocksReply(conn net.Conn, rep byte, addr string) error {
+	_, err := conn.Write(append([]byte{socksVer5, rep, 0x00}, encodeSocksAddr(addr)...))
+	return err
+}
+
+// encodeSocksAddr encodes host:port as ATYP, address and port.
+func encodeSocksAddr(hostport string) []byte {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return []byte{socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	port, _ := strconv.Atoi(portStr)
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			host = host[:255]
+		}
+		b = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAddrIPv6}, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// parseSocksAddr decodes an ATYP, address and port at the start of b. It
+// returns host:port and the number of bytes used.
+func parseSocksAddr(b []byte) (hostport string, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, errShortAddr
+	}
+	var host string
+	switch b[0] {
+	case socksAddrIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return "", 0, errShortAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAddrIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return "", 0, errShortAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAddrDomain:
+		if len(b) < 2 {
+			return "", 0, errShortAddr
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, errShortAddr
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, errAddrType
+	}
+	port := binary.BigEndian.Uint16(b[n : n+2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/snaigle/dproxy/util"
+	"net"
+)
+
+// loadTLSConfig builds the tls config of the tunnel listener. When
+// clientCA is set clients must present a certificate signed by it.
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		if config.ClientCAs, err = util.LoadCertPool(clientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// tlsIdentity returns the common name of the verified client certificate
+// on conn, or the empty string if the client didn't present one.
+func tlsIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -17,7 +17,7 @@ func handleTunnelConnection(conn net.Conn) {
 	}()
 	var err error
 	var rawMsg msg.Message
-	conn.SetReadDeadline(time.Now().Add(connReadTimeout))
+	conn.SetReadDeadline(time.Now().Add(time.Duration(opts.ReadTimeout)))
 	if rawMsg, err = msg.ReadMsg(conn); err != nil {
 		log.Println("read msg error:", err)
 		conn.Close()
@@ -29,6 +29,8 @@ func handleTunnelConnection(conn net.Conn) {
 		newControl(conn, m)
 	case *msg.RegProxy:
 		newProxy(conn, m)
+	case *msg.RegMux:
+		newMuxSession(conn, m)
 	default:
 		conn.Close()
 	}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/snaigle/dproxy/msg"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	// RSV(2) FRAG(1) in front of the address of a socks5 udp datagram
+	socksUdpHeaderLen = 3
+	maxDatagramSize   = 64 * 1024
+)
+
+// handleUdpAssociate serves a SOCKS5 UDP ASSOCIATE request. It binds a UDP
+// socket for the SOCKS client and relays its datagrams over a proxy
+// connection to the exit client, which sends them from its own network.
+// The association lasts as long as the TCP connection of the request.
+// Datagrams to destinations the user may not connect to are dropped.
+func handleUdpAssociate(conn net.Conn, route *Route, ctl *Control, u *UsageRecord) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Println("failed to listen udp:", err)
+		writeSocksReply(conn, socksRepGeneralFailure, "")
+		return
+	}
+	defer pc.Close()
+
+	proxy, err := startProxyConn(ctl, &msg.StartUdpRelay{})
+	if err != nil {
+		log.Println("failed get proxy connection:", err)
+		socksFailed.Inc(socksFailNoProxy)
+		writeSocksReply(conn, socksRepGeneralFailure, "")
+		return
+	}
+	defer proxy.Close()
+
+	if err = writeSocksReply(conn, socksRepSucceeded, pc.LocalAddr().String()); err != nil {
+		log.Println("send udp associate reply:", err)
+		return
+	}
+	log.Println("udp associate on", pc.LocalAddr())
+
+	// the association ends when the socks client closes the tcp connection
+	var up, down int64
+	var userClosed int32
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		atomic.StoreInt32(&userClosed, 1)
+		pc.Close()
+		proxy.Close()
+	}()
+	defer func() {
+		u.BytesUp, u.BytesDown = atomic.LoadInt64(&up), atomic.LoadInt64(&down)
+		if atomic.LoadInt32(&userClosed) == 1 {
+			u.finish(closeByUser)
+		} else {
+			u.finish(closeByExit)
+		}
+	}()
+
+	// datagrams are only accepted from the host of the tcp connection, the
+	// first one tells us which port it sends from
+	peerIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	peerAddr := make(chan *net.UDPAddr, 1)
+	go relayDatagramsFromClient(proxy, pc, peerAddr, u, &down)
+
+	buf := make([]byte, maxDatagramSize)
+	var peer *net.UDPAddr
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(peerIP) {
+			continue
+		}
+		if peer == nil {
+			peer = from
+			peerAddr <- from
+		}
+		// fragmentation isn't supported, drop fragments
+		if n < socksUdpHeaderLen || buf[2] != 0 {
+			continue
+		}
+		addr, hdrLen, err := parseSocksAddr(buf[socksUdpHeaderLen:n])
+		if err != nil {
+			continue
+		}
+		if !allowDest(u.User, route, ctl, addr) {
+			continue
+		}
+		data := buf[socksUdpHeaderLen+hdrLen : n]
+		u.wait(len(data))
+		if err = msg.WriteMsg(proxy, &msg.Datagram{Addr: addr, Data: data}); err != nil {
+			log.Println("failed to relay datagram:", err)
+			return
+		}
+		atomic.AddInt64(&up, int64(len(data)))
+	}
+}
+
+// relayDatagramsFromClient sends datagrams arriving from the exit client to
+// the socks client, once we know its address, within the rate limits of u
+// and adds their size to down.
+func relayDatagramsFromClient(proxy net.Conn, pc *net.UDPConn, peerAddr chan *net.UDPAddr, u *UsageRecord, down *int64) {
+	defer pc.Close()
+	var peer *net.UDPAddr
+	for {
+		var d msg.Datagram
+		if err := msg.ReadMsgInto(proxy, &d); err != nil {
+			return
+		}
+		if peer == nil {
+			select {
+			case peer = <-peerAddr:
+			default:
+				// nobody to deliver to yet
+				continue
+			}
+		}
+		u.wait(len(d.Data))
+		b := append([]byte{0, 0, 0}, encodeSocksAddr(d.Addr)...)
+		if _, err := pc.WriteToUDP(append(b, d.Data...), peer); err != nil {
+			return
+		}
+		atomic.AddInt64(down, int64(len(d.Data)))
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/snaigle/dproxy/msg"
+	"github.com/snaigle/dproxy/util"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protocols of usage records
+const (
+	usageSocks       = "socks5"
+	usageSocksBind   = "socks5-bind"
+	usageSocksUdp    = "socks5-udp"
+	usageHttpConnect = "http-connect"
+	usageHttp        = "http"
+)
+
+// why a relayed connection ended, by the side that ended it first
+const (
+	closeByUser      = "user-closed"
+	closeByUserError = "user-error"
+	closeByExit      = "exit-closed"
+	closeByExitError = "exit-error"
+)
+
+// UsageRecord accounts one relayed connection. Up is from the proxy user
+// towards the target, down the other way. User is the account of the proxy
+// user, see limitUser, and ResolvedAddr the address the client connected
+// to for the target.
+type UsageRecord struct {
+	User         string    `json:"user"`
+	ClientId     string    `json:"clientId"`
+	CityCode     string    `json:"cityCode"`
+	Protocol     string    `json:"protocol"`
+	Target       string    `json:"target"`
+	ResolvedAddr string    `json:"resolvedAddr,omitempty"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	BytesUp      int64     `json:"bytesUp"`
+	BytesDown    int64     `json:"bytesDown"`
+	CloseReason  string    `json:"closeReason"`
+
+	// the rate limits the connection is relayed under
+	limits []*util.RateLimiter
+}
+
+// newUsage starts the record of a connection of user, which route sent to
+// ctl, and looks up the rate limits it is subject to.
+func newUsage(user string, route *Route, ctl *Control, protocol, target string) *UsageRecord {
+	return &UsageRecord{
+		User:     limitUser(user, route),
+		ClientId: ctl.id,
+		CityCode: ctl.auth.CityCode,
+		Protocol: protocol,
+		Target:   target,
+		Start:    time.Now(),
+		limits:   rateLimits(limitUser(user, route), ctl),
+	}
+}
+
+// connected records where the client connected to for the target.
+func (u *UsageRecord) connected(result msg.DialResult) {
+	u.ResolvedAddr = result.RemoteAddr
+	if result.RemoteAddr != "" {
+		log.Printf("connected to %s at %s\n", u.Target, result.RemoteAddr)
+	}
+}
+
+// wait blocks until the rate limits of the connection allow n more bytes.
+func (u *UsageRecord) wait(n int) {
+	for _, l := range u.limits {
+		l.Wait(n)
+	}
+}
+
+// finish completes the record and hands it to the usage sink.
+func (u *UsageRecord) finish(reason string) {
+	u.End = time.Now()
+	u.CloseReason = reason
+	if usageSink == nil {
+		return
+	}
+	if err := usageSink.Write(u); err != nil {
+		log.Println("failed to write usage record:", err)
+	}
+}
+
+// relay copies between the connection of the proxy user and the proxy
+// connection, within the rate limits of u, until both directions are done,
+// then finishes u.
+func relay(conn, proxy net.Conn, u *UsageRecord) {
+	type result struct {
+		up  bool
+		n   int64
+		err error
+	}
+	done := make(chan result, 2)
+	go func() {
+		n, err := util.PipeThenClose(conn, proxy, u.limits...)
+		done <- result{true, n, err}
+	}()
+	go func() {
+		n, err := util.PipeThenClose(proxy, conn, u.limits...)
+		done <- result{false, n, err}
+	}()
+
+	// a direction ending without error was closed by its source, the
+	// other one only ended because of that; when it's unclear the first
+	// direction to end decides
+	var results []result
+	for i := 0; i < 2; i++ {
+		r := <-done
+		if r.up {
+			u.BytesUp += r.n
+		} else {
+			u.BytesDown += r.n
+		}
+		results = append(results, r)
+	}
+	first := results[0]
+	if (results[0].err == nil) != (results[1].err == nil) && results[1].err == nil {
+		first = results[1]
+	}
+	var reason string
+	switch {
+	case first.up && first.err == nil:
+		reason = closeByUser
+	case first.up:
+		reason = closeByUserError
+	case first.err == nil:
+		reason = closeByExit
+	default:
+		reason = closeByExitError
+	}
+	u.finish(reason)
+}
+
+// countingConn counts the bytes read from and written to a connection and
+// keeps them within the rate limits of u.
+type countingConn struct {
+	net.Conn
+	u             *UsageRecord
+	read, written int64
+}
+
+func (c *countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.read += int64(n)
+	c.u.wait(n)
+	return
+}
+
+func (c *countingConn) Write(b []byte) (n int, err error) {
+	c.u.wait(len(b))
+	n, err = c.Conn.Write(b)
+	c.written += int64(n)
+	return
+}
+
+// UsageSink stores usage records. Close is called when the server shuts
+// down and must not lose the records written before.
+type UsageSink interface {
+	Write(u *UsageRecord) error
+	Close() error
+}
+
+// MultiUsageSink writes records to all of its sinks.
+type MultiUsageSink []UsageSink
+
+func (m MultiUsageSink) Write(u *UsageRecord) (err error) {
+	for _, s := range m {
+		if e := s.Write(u); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (m MultiUsageSink) Close() (err error) {
+	for _, s := range m {
+		if e := s.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// FileUsageSink appends records to a file as json lines. With a maxSize it
+// rotates the file once it would grow beyond maxSize bytes, renaming it to
+// path.<timestamp> and keeping at most maxBackups of them, 0 keeps all.
+type FileUsageSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	sync.Mutex
+}
+
+func NewFileUsageSink(path string, maxSize int64, maxBackups int) (*FileUsageSink, error) {
+	s := &FileUsageSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileUsageSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *FileUsageSink) Write(u *UsageRecord) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileUsageSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
+
+func (s *FileUsageSink) rotate() error {
+	s.file.Close()
+	backup := s.path + "." + time.Now().Format("20060102-150405.000000000")
+	if err := os.Rename(s.path, backup); err != nil {
+		log.Println("failed to rotate usage file:", err)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.maxBackups <= 0 {
+		return nil
+	}
+	// the timestamps sort in the order the backups were made
+	backups, _ := filepath.Glob(s.path + ".*")
+	sort.Strings(backups)
+	for len(backups) > s.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+const (
+	webhookBatchSize  = 100
+	webhookQueueSize  = 10000
+	webhookInterval   = 5 * time.Second
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// WebhookUsageSink posts records as json arrays to an http endpoint. They
+// are sent in the background in batches; a batch that fails is retried
+// with a growing backoff until the endpoint takes it. Records that don't
+// fit in the queue meanwhile, and those still queued when the sink closes,
+// are appended to a spool file as json lines, which is posted once the
+// endpoint takes records again, also after a restart.
+type WebhookUsageSink struct {
+	url    string
+	client *http.Client
+	queue  chan *UsageRecord
+
+	spool     string
+	spoolLock sync.Mutex
+
+	// set by Close, writes go to the spool file afterwards
+	closing bool
+	sync.RWMutex
+
+	closed  chan struct{}
+	stopped chan struct{}
+}
+
+func NewWebhookUsageSink(url, spool string) *WebhookUsageSink {
+	s := &WebhookUsageSink{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *UsageRecord, webhookQueueSize),
+		spool:   spool,
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.sender()
+	return s
+}
+
+func (s *WebhookUsageSink) Write(u *UsageRecord) error {
+	s.RLock()
+	defer s.RUnlock()
+	if !s.closing {
+		select {
+		case s.queue <- u:
+			return nil
+		default:
+		}
+	}
+	return s.spoolRecords([]*UsageRecord{u})
+}
+
+// Close stops the sender after it posted the queued records one more
+// time, the ones that don't go through are spooled.
+func (s *WebhookUsageSink) Close() error {
+	s.Lock()
+	if s.closing {
+		s.Unlock()
+		return nil
+	}
+	s.closing = true
+	s.Unlock()
+	close(s.closed)
+	<-s.stopped
+	return nil
+}
+
+func (s *WebhookUsageSink) sender() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+	var batch []*UsageRecord
+	// records spooled before a restart are sent first
+	nextReplay := time.Now()
+	for {
+		select {
+		case u := <-s.queue:
+			if batch = append(batch, u); len(batch) < webhookBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-s.closed:
+			s.flush(batch)
+			return
+		}
+		if len(batch) > 0 {
+			if !s.send(batch) {
+				s.flush(batch)
+				return
+			}
+			batch = nil
+			// the endpoint is up again
+			nextReplay = time.Now()
+		}
+		if time.Now().After(nextReplay) {
+			if err := s.replaySpool(); err != nil {
+				log.Println("failed to post spooled usage records:", err)
+				nextReplay = time.Now().Add(webhookMaxBackoff)
+			}
+		}
+	}
+}
+
+// send posts batch, retrying with a growing backoff until it succeeds. It
+// returns false if the sink closes first.
+func (s *WebhookUsageSink) send(batch []*UsageRecord) bool {
+	backoff := webhookMinBackoff
+	for {
+		err := s.post(batch)
+		if err == nil {
+			return true
+		}
+		log.Printf("failed to post %d usage records, retrying in %v: %v\n", len(batch), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-s.closed:
+			return false
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// flush posts batch and the records left in the queue once, and spools
+// them if that fails.
+func (s *WebhookUsageSink) flush(batch []*UsageRecord) {
+drain:
+	for {
+		select {
+		case u := <-s.queue:
+			batch = append(batch, u)
+		default:
+			break drain
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	err := s.post(batch)
+	if err == nil {
+		return
+	}
+	log.Printf("failed to post %d usage records, spooling them: %v\n", len(batch), err)
+	if err = s.spoolRecords(batch); err != nil {
+		log.Printf("lost %d usage records: %v\n", len(batch), err)
+	}
+}
+
+func (s *WebhookUsageSink) post(batch []*UsageRecord) error {
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// spoolRecords appends records to the spool file.
+func (s *WebhookUsageSink) spoolRecords(records []*UsageRecord) error {
+	if s.spool == "" {
+		return fmt.Errorf("no spool file, dropping %d usage records", len(records))
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, u := range records {
+		if err := enc.Encode(u); err != nil {
+			return err
+		}
+	}
+	s.spoolLock.Lock()
+	defer s.spoolLock.Unlock()
+	f, err := os.OpenFile(s.spool, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaySpool posts the records of the spool file. It moves the file
+// aside first, so records can be spooled meanwhile; a file left aside by
+// a crash is posted before the spool file.
+func (s *WebhookUsageSink) replaySpool() error {
+	if s.spool == "" {
+		return nil
+	}
+	sending := s.spool + ".sending"
+	s.spoolLock.Lock()
+	_, err := os.Stat(sending)
+	if os.IsNotExist(err) {
+		err = os.Rename(s.spool, sending)
+	}
+	s.spoolLock.Unlock()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(sending)
+	if err != nil {
+		return err
+	}
+	var records []*UsageRecord
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		u := new(UsageRecord)
+		if err = json.Unmarshal(line, u); err != nil {
+			log.Println("skipping invalid spooled usage record:", err)
+			continue
+		}
+		records = append(records, u)
+	}
+	for len(records) > 0 {
+		n := webhookBatchSize
+		if n > len(records) {
+			n = len(records)
+		}
+		if err = s.post(records[:n]); err != nil {
+			break
+		}
+		records = records[n:]
+	}
+	if len(records) > 0 {
+		// back into the spool, the file aside is done either way
+		if e := s.spoolRecords(records); e != nil {
+			return e
+		}
+	}
+	os.Remove(sending)
+	if err == nil {
+		log.Println("posted spooled usage records")
+	}
+	return err
+}
+
+// newUsageSink builds the sink of the configured usage outputs, nil if
+// there are none.
+func newUsageSink(c *Config) (UsageSink, error) {
+	var sinks MultiUsageSink
+	if c.UsageFile != "" {
+		s, err := NewFileUsageSink(c.UsageFile, int64(c.UsageFileMaxSize)<<20, c.UsageFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if c.UsageWebhook != "" {
+		if !strings.HasPrefix(c.UsageWebhook, "http://") && !strings.HasPrefix(c.UsageWebhook, "https://") {
+			return nil, fmt.Errorf("invalid usage webhook %q", c.UsageWebhook)
+		}
+		sinks = append(sinks, NewWebhookUsageSink(c.UsageWebhook, c.UsageWebhookSpool))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRecord(i int) *UsageRecord {
+	return &UsageRecord{
+		User:        fmt.Sprintf("user%02d", i),
+		ClientId:    "84e6f3dd352c8d8d",
+		CityCode:    "110000",
+		Protocol:    usageSocks,
+		Target:      "example.com:443",
+		Start:       time.Unix(1700000000, 0).UTC(),
+		End:         time.Unix(1700000060, 0).UTC(),
+		BytesUp:     int64(1000 + i),
+		BytesDown:   int64(2000 + i),
+		CloseReason: closeByUser,
+	}
+}
+
+// readRecords reads the json lines of a usage or spool file.
+func readRecords(t *testing.T, path string) []*UsageRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []*UsageRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		u := new(UsageRecord)
+		if err = json.Unmarshal(scanner.Bytes(), u); err != nil {
+			t.Fatalf("invalid line %q in %s: %v", scanner.Text(), path, err)
+		}
+		records = append(records, u)
+	}
+	return records
+}
+
+func TestFileUsageSinkRotate(t *testing.T) {
+	line, _ := json.Marshal(testRecord(0))
+	size := int64(len(line) + 1)
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		records    int
+		files      int // including the current one
+	}{
+		{"no rotation", 0, 0, 10, 1},
+		{"fits", 10 * size, 0, 10, 1},
+		{"one record too many", 10 * size, 0, 11, 2},
+		{"keeps all backups", 3 * size, 0, 10, 4},
+		{"keeps some backups", 3 * size, 2, 10, 3},
+		{"records larger than the file", 1, 1, 3, 2},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "usage.jsonl")
+		s, err := NewFileUsageSink(path, tt.maxSize, tt.maxBackups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.records; i++ {
+			if err = s.Write(testRecord(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+
+		files, _ := filepath.Glob(path + "*")
+		if len(files) != tt.files {
+			t.Errorf("%s: %d files, want %d", tt.name, len(files), tt.files)
+		}
+		// the newest records are kept, each file within the size
+		var n int
+		for _, f := range files {
+			fi, _ := os.Stat(f)
+			if tt.maxSize > size && fi.Size() > tt.maxSize {
+				t.Errorf("%s: %s has %d bytes, more than %d", tt.name, f, fi.Size(), tt.maxSize)
+			}
+			n += len(readRecords(t, f))
+		}
+		if last := readRecords(t, path); len(last) == 0 || last[len(last)-1].User != fmt.Sprintf("user%02d", tt.records-1) {
+			t.Errorf("%s: the last record isn't in the current file", tt.name)
+		}
+		if tt.maxBackups == 0 && n != tt.records {
+			t.Errorf("%s: %d records in the files, want %d", tt.name, n, tt.records)
+		}
+	}
+}
+
+// webhook is an endpoint taking usage records while it is up.
+type webhook struct {
+	up      bool
+	records []*UsageRecord
+	sync.Mutex
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if !h.up {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	var batch []*UsageRecord
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.records = append(h.records, batch...)
+}
+
+func (h *webhook) set(up bool) {
+	h.Lock()
+	h.up = up
+	h.Unlock()
+}
+
+func (h *webhook) received() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.records)
+}
+
+func TestWebhookUsageSinkSpool(t *testing.T) {
+	h := &webhook{up: true}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+
+	// queued records are posted when the sink closes
+	s := NewWebhookUsageSink(srv.URL, spool)
+	for i := 0; i < 3; i++ {
+		s.Write(testRecord(i))
+	}
+	s.Close()
+	if n := h.received(); n != 3 {
+		t.Fatalf("posted %d records, want 3", n)
+	}
+
+	// with the endpoint down they are spooled, as are records written
+	// after the sink closed
+	h.set(false)
+	s = NewWebhookUsageSink(srv.URL, spool)
+	for i := 3; i < 6; i++ {
+		s.Write(testRecord(i))
+	}
+	s.Close()
+	s.Write(testRecord(6))
+	if n := len(readRecords(t, spool)); n != 4 {
+		t.Fatalf("spooled %d records, want 4", n)
+	}
+
+	// a failed replay keeps them
+	s = NewWebhookUsageSink(srv.URL, spool)
+	if err := s.replaySpool(); err == nil {
+		t.Fatal("replayed to an endpoint that is down")
+	}
+	if n := len(readRecords(t, spool)); n != 4 {
+		t.Fatalf("%d records left in the spool, want 4", n)
+	}
+
+	// and the next one posts them, skipping broken lines
+	f, _ := os.OpenFile(spool, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("{broken\n")
+	f.Close()
+	h.set(true)
+	if err := s.replaySpool(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if n := h.received(); n != 7 {
+		t.Fatalf("posted %d records, want 7", n)
+	}
+	for i, u := range h.records {
+		if u.User != fmt.Sprintf("user%02d", i) || u.BytesDown != int64(2000+i) {
+			t.Errorf("record %d is %+v", i, u)
+		}
+	}
+	if files, _ := filepath.Glob(spool + "*"); len(files) != 0 {
+		t.Errorf("spool files left: %v", files)
+	}
+}
+
+func TestWebhookUsageSinkReplayLeftAside(t *testing.T) {
+	h := &webhook{up: true}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+
+	// a crash during a replay leaves the file aside, it goes first
+	line, _ := json.Marshal(testRecord(0))
+	ioutil.WriteFile(spool+".sending", append(line, '\n'), 0644)
+	line, _ = json.Marshal(testRecord(1))
+	ioutil.WriteFile(spool, append(line, '\n'), 0644)
+	s := NewWebhookUsageSink(srv.URL, spool)
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if err := s.replaySpool(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := h.received(); n != 2 || h.records[0].User != "user00" {
+		t.Fatalf("posted %d records in the wrong order", n)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/snaigle/dproxy/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errProxyAuth      = errors.New("invalid proxy username or password")
+	errUserExpired    = errors.New("proxy user expired")
+	errDestNotAllowed = errors.New("destination not allowed")
+)
+
+// ProxyUser is an account of the socks5 and http proxies.
+type ProxyUser struct {
+	Name string `json:"name"`
+
+	// bcrypt hash, or argon2id in the $argon2id$v=19$m=,t=,p=$salt$hash
+	// format, see -hash-password
+	Password string `json:"password"`
+
+	// the cities whose clients the user may use, empty allows all
+	Cities []string `json:"cities,omitempty"`
+
+	// target ports the user may connect to, single ports or ranges like
+	// "8000-8999", empty allows all
+	Ports []string `json:"ports,omitempty"`
+
+	// when the account stops working, zero never
+	Expires time.Time `json:"expires"`
+
+	ports []util.PortRange
+}
+
+// AllowsCity reports whether the user may use clients of city.
+func (u *ProxyUser) AllowsCity(city string) bool {
+	return len(u.Cities) == 0 || containsString(u.Cities, city)
+}
+
+// AllowsAddr reports whether the user may connect to the host:port addr.
+func (u *ProxyUser) AllowsAddr(addr string) bool {
+	return len(u.ports) == 0 || util.MatchPort(u.ports, addr)
+}
+
+// UserStore holds the proxy users of a json file, a list of ProxyUser. The
+// file is reloaded when its modification time changes.
+type UserStore struct {
+	path    string
+	modTime time.Time
+	users   map[string]*ProxyUser
+
+	// sha256 of the passwords that matched the hash of a user, checking
+	// bcrypt or argon2 hashes on every connection is too slow
+	verified map[string][sha256.Size]byte
+
+	// checked for unknown users, so they take as long as known ones and
+	// the response time doesn't tell which account names exist
+	dummyHash string
+
+	sync.RWMutex
+}
+
+func NewUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.dummyHash, err = hashPassword(util.RandSecret(16)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *UserStore) reload() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.RLock()
+	unchanged := fi.ModTime().Equal(s.modTime)
+	s.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []*ProxyUser
+	if err = json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("invalid user file %s: %v", s.path, err)
+	}
+	users := make(map[string]*ProxyUser, len(list))
+	for _, u := range list {
+		if !validUserName(u.Name) {
+			return fmt.Errorf("invalid user name %q in %s", u.Name, s.path)
+		}
+		if err = checkHash(u.Password); err != nil {
+			return fmt.Errorf("password of user %s in %s: %v", u.Name, s.path, err)
+		}
+		if u.ports, err = util.ParsePortRanges(u.Ports); err != nil {
+			return fmt.Errorf("user %s in %s: %v", u.Name, s.path, err)
+		}
+		users[u.Name] = u
+	}
+
+	s.Lock()
+	s.users = users
+	s.verified = make(map[string][sha256.Size]byte)
+	s.modTime = fi.ModTime()
+	s.Unlock()
+	log.Printf("loaded %d proxy users from %s\n", len(users), s.path)
+	return nil
+}
+
+// validUserName reports whether name can be the account of a proxy
+// username, which it couldn't if it contained a routing key.
+func validUserName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, t := range strings.Split(name, "-") {
+		if t == "" || isRouteKey(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticate returns the user of name if password is right and the
+// account didn't expire.
+func (s *UserStore) Authenticate(name, password string) (*ProxyUser, error) {
+	if err := s.reload(); err != nil {
+		// keep serving with the users we already have
+		log.Println("failed to reload user file:", err)
+	}
+	s.RLock()
+	u := s.users[name]
+	verified, ok := s.verified[name]
+	s.RUnlock()
+	if u == nil {
+		checkPassword(s.dummyHash, password)
+		return nil, errProxyAuth
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	if !ok || subtle.ConstantTimeCompare(sum[:], verified[:]) != 1 {
+		if !checkPassword(u.Password, password) {
+			return nil, errProxyAuth
+		}
+		s.Lock()
+		// a reload in between may have changed the user
+		if s.users[name] == u {
+			s.verified[name] = sum
+		}
+		s.Unlock()
+	}
+	if !u.Expires.IsZero() && time.Now().After(u.Expires) {
+		return nil, errUserExpired
+	}
+	return u, nil
+}
+
+// Bounds of the hashes in the user file. Each login computes the hash, so
+// the parameters decide how much cpu and memory an attempt costs.
+const (
+	maxArgon2Memory  = 256 * 1024 // KiB
+	maxArgon2Passes  = 16
+	maxArgon2KeySize = 128
+	maxBcryptCost    = 16
+)
+
+type argon2Hash struct {
+	memory, passes uint32
+	threads        uint8
+	salt, key      []byte
+}
+
+// parseArgon2 parses an argon2id hash in the
+// $argon2id$v=19$m=,t=,p=$salt$hash format and checks its parameters.
+func parseArgon2(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v=19" {
+		return nil, errors.New("invalid argon2id hash")
+	}
+	h := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.passes, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if h.passes < 1 || h.passes > maxArgon2Passes {
+		return nil, fmt.Errorf("argon2id t=%d out of range 1-%d", h.passes, maxArgon2Passes)
+	}
+	if h.threads < 1 {
+		return nil, errors.New("argon2id p must be at least 1")
+	}
+	if h.memory < 8*uint32(h.threads) || h.memory > maxArgon2Memory {
+		return nil, fmt.Errorf("argon2id m=%d out of range %d-%d", h.memory, 8*uint32(h.threads), maxArgon2Memory)
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2id salt")
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 || len(h.key) > maxArgon2KeySize {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return h, nil
+}
+
+// checkHash reports why hash can't be the password of a user, if it can't.
+func checkHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, err := parseArgon2(hash)
+		return err
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return err
+	}
+	if cost > maxBcryptCost {
+		return fmt.Errorf("bcrypt cost %d above %d", cost, maxBcryptCost)
+	}
+	return nil
+}
+
+// checkPassword compares password with a bcrypt or argon2id hash, hashes
+// out of bounds never match.
+func checkPassword(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return checkHash(hash) == nil &&
+			bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), h.salt, h.passes, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(h.key, other) == 1
+}
+
+// hashPassword returns the bcrypt hash of password for the user file.
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// proxyRoute checks proxy credentials and parses the route they select.
+// Without a user store any credentials are accepted, see parseRoute. With
+// one the account in front of the routing keys is the user name and the
+// password is only checked, the route is limited to what the user may use
+// and may leave out the city to use any client.
+func proxyRoute(username, password string) (*Route, error) {
+	if userStore == nil {
+		return parseRoute(username, password)
+	}
+	r, err := parseRoute(username, "")
+	if err != nil {
+		return nil, err
+	}
+	if r.User, err = userStore.Authenticate(r.Account, password); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func argon2idHash(password, params string, memory, passes uint32, threads uint8) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, passes, memory, threads, 32)
+	return fmt.Sprintf("$argon2id$v=19$%s$%s$%s", params,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	argonHash := argon2idHash("secret", "m=64,t=1,p=2", 64, 1, 2)
+	key := "$MDEyMzQ1Njc4OWFiY2RlZg$MDEyMzQ1Njc4OWFiY2RlZg"
+
+	tests := []struct {
+		hash     string
+		valid    bool
+		password string
+		match    bool
+	}{
+		{string(bcryptHash), true, "secret", true},
+		{string(bcryptHash), true, "wrong", false},
+		{argonHash, true, "secret", true},
+		{argonHash, true, "wrong", false},
+		{"$2a$31$" + string(bcryptHash[7:]), false, "secret", false},
+		{"", false, "", false},
+		{"secret", false, "secret", false},
+		{"$2a$10$short", false, "secret", false},
+		{"$argon2id$v=19$m=64,t=0,p=1" + key, false, "secret", false},
+		{"$argon2id$v=19$m=64,t=17,p=1" + key, false, "secret", false},
+		{"$argon2id$v=19$m=64,t=1,p=0" + key, false, "secret", false},
+		{"$argon2id$v=19$m=8,t=1,p=2" + key, false, "secret", false},
+		{"$argon2id$v=19$m=4194304,t=1,p=1" + key, false, "secret", false},
+		{"$argon2id$v=19$m=64,t=1" + key, false, "secret", false},
+		{"$argon2id$v=18$m=64,t=1,p=1" + key, false, "secret", false},
+		{"$argon2id$v=19$m=64,t=1,p=1$!!$MDEy", false, "secret", false},
+		{"$argon2id$v=19$m=64,t=1,p=1$MDEy$", false, "secret", false},
+	}
+	for _, tt := range tests {
+		if err := checkHash(tt.hash); (err == nil) != tt.valid {
+			t.Errorf("checkHash(%q) = %v, want valid %v", tt.hash, err, tt.valid)
+		}
+		if got := checkPassword(tt.hash, tt.password); got != tt.match {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.match)
+		}
+	}
+}
+
+func TestUserStoreRejectsBadHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	good, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	write := func(hash string) {
+		b := fmt.Sprintf(`[{"name": "alice", "password": %q}]`, hash)
+		if err := ioutil.WriteFile(path, []byte(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("$argon2id$v=19$m=64,t=0,p=1$MDEy$MDEy")
+	if _, err := NewUserStore(path); err == nil {
+		t.Fatal("loaded a user file with a bad hash")
+	}
+
+	write(string(good))
+	s, err := NewUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a bad reload keeps the users that were loaded
+	write("$argon2id$v=19$m=64,t=1,p=0$MDEy$MDEy")
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if _, err = s.Authenticate("alice", "secret"); err != nil {
+		t.Fatal("authenticate after a bad reload:", err)
+	}
+}
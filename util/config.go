@@ -0,0 +1,232 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as "30s" or "1m30s" in config
+// files, environment variables and flags.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	return d.Set(string(b))
+}
+
+// ByteSize is a number of bytes written as 1048576, "512KB", "10MB" or
+// "1.5GB" in config files, environment variables and flags. The units are
+// powers of 1024.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+func (b ByteSize) String() string {
+	for _, u := range byteUnits[:4] {
+		if b != 0 && int64(b)%u.size == 0 {
+			return strconv.FormatInt(int64(b)/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *ByteSize) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid byte size %q", s)
+	}
+	*b = ByteSize(v * float64(unit))
+	return nil
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// UnmarshalJSON accepts plain numbers beside strings.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return b.Set(s)
+}
+
+// StringList is a list written as a json array in config files and as a
+// comma separated list in environment variables and flags.
+type StringList []string
+
+func (l StringList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *StringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// LoadConfig decodes the config file at path into the struct pointed to
+// by v. The format is picked by the file extension: .json, .yaml, .yml or
+// .toml. Every format is matched against the json tags of v, so a struct
+// only has to describe its keys once.
+func LoadConfig(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return json.Unmarshal(b, v)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+		raw = normalizeYAML(raw)
+	case ".toml":
+		_, err = toml.Decode(string(b), &raw)
+	default:
+		return fmt.Errorf("unsupported config file format: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if b, err = json.Marshal(raw); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// normalizeYAML turns the map[interface{}]interface{} values produced by
+// yaml into map[string]interface{} so they can be encoded as json.
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = normalizeYAML(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range t {
+			t[i] = normalizeYAML(v)
+		}
+	}
+	return v
+}
+
+// LoadEnv overrides the fields of the struct pointed to by v with the
+// environment variables named in their env tags.
+func LoadEnv(v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name := rt.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(rv.Field(i), s); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, s string) error {
+	// Duration, ByteSize and other flag values parse themselves
+	if v, ok := f.Addr().Interface().(interface{ Set(string) error }); ok {
+		return v.Set(s)
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
+
+// Redacted returns a copy of the struct v points to whose non-empty string
+// fields tagged `secret:"true"` are masked, for printing configs.
+func Redacted(v interface{}) interface{} {
+	rv := reflect.ValueOf(v).Elem()
+	cp := reflect.New(rv.Type())
+	cp.Elem().Set(rv)
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := cp.Elem().Field(i)
+		if t.Field(i).Tag.Get("secret") == "true" && f.Kind() == reflect.String && f.String() != "" {
+			f.SetString("******")
+		}
+	}
+	return cp.Interface()
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// DestList matches destinations against networks, given as CIDRs or IPs,
+// and host name globs like "*.example.com".
+type DestList struct {
+	Nets  []*net.IPNet
+	Hosts []string
+}
+
+func ParseDestList(dests []string) (l DestList, err error) {
+	for _, d := range dests {
+		if strings.Contains(d, "/") {
+			_, n, err := net.ParseCIDR(d)
+			if err != nil {
+				return l, fmt.Errorf("invalid destination %q: %v", d, err)
+			}
+			l.Nets = append(l.Nets, n)
+		} else if ip := net.ParseIP(d); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			l.Nets = append(l.Nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if _, err := path.Match(d, ""); err != nil {
+			return l, fmt.Errorf("invalid destination %q: %v", d, err)
+		} else {
+			l.Hosts = append(l.Hosts, strings.ToLower(d))
+		}
+	}
+	return
+}
+
+func (l DestList) Empty() bool {
+	return len(l.Nets) == 0 && len(l.Hosts) == 0
+}
+
+func (l DestList) MatchIP(ip net.IP) bool {
+	for _, n := range l.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHost matches a host name, ignoring case and a trailing dot.
+func (l DestList) MatchHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, g := range l.Hosts {
+		if ok, _ := path.Match(g, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match matches a host that is either an IP or a host name.
+func (l DestList) Match(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return l.MatchIP(ip)
+	}
+	return l.MatchHost(host)
+}
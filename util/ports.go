@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a range of ports including both ends.
+type PortRange struct {
+	From, To int
+}
+
+// ParsePortRanges parses single ports like "443" and ranges like
+// "8000-8999".
+func ParsePortRanges(list []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, s := range list {
+		from, to := s, s
+		if i := strings.Index(s, "-"); i >= 0 {
+			from, to = s[:i], s[i+1:]
+		}
+		f, err1 := strconv.Atoi(strings.TrimSpace(from))
+		t, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || f < 1 || t > 65535 || f > t {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		ranges = append(ranges, PortRange{f, t})
+	}
+	return ranges, nil
+}
+
+// MatchPort reports whether the port of the host:port addr is in one of
+// ranges.
+func MatchPort(ranges []PortRange, addr string) bool {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
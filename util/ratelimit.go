@@ -0,0 +1,61 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting a byte rate. The bucket holds up
+// to a second worth of bytes. A nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// LastUsed returns when bytes were last taken from the bucket.
+func (l *RateLimiter) LastUsed() time.Time {
+	l.Lock()
+	defer l.Unlock()
+	return l.last
+}
+
+// Wait takes n bytes from the bucket and blocks until the rate allows
+// them. Larger takes than the bucket holds leave it in debt, which later
+// callers wait for.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if wait := l.take(n, time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// take refills the bucket up to now, takes n bytes and returns how long
+// the caller has to wait for them.
+func (l *RateLimiter) take(n int, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = now
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	tests := []struct {
+		name  string
+		takes []int       // bytes taken in turn
+		times []time.Time // when they are taken
+		want  time.Duration
+	}{
+		{"within the bucket", []int{1000}, []time.Time{at(0)}, 0},
+		{"empties the bucket", []int{400, 600}, []time.Time{at(0), at(0)}, 0},
+		{"one byte too many", []int{1000, 1}, []time.Time{at(0), at(0)}, time.Millisecond},
+		{"twice the bucket", []int{2000}, []time.Time{at(0)}, time.Second},
+		{"debt adds up", []int{2000, 500}, []time.Time{at(0), at(0)}, 1500 * time.Millisecond},
+		{"refills with time", []int{1000, 500}, []time.Time{at(0), at(500)}, 0},
+		{"refills partly", []int{1000, 500}, []time.Time{at(0), at(250)}, 250 * time.Millisecond},
+		{"pays off debt", []int{2000, 100}, []time.Time{at(0), at(1000)}, 100 * time.Millisecond},
+		{"holds a second at most", []int{1000, 1500}, []time.Time{at(0), at(5000)}, 500 * time.Millisecond},
+		{"ignores an earlier clock", []int{1000, 100}, []time.Time{at(0), at(-1000)}, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		l := NewRateLimiter(1000)
+		l.last = start
+		var got time.Duration
+		for i, n := range tt.takes {
+			got = l.take(n, tt.times[i])
+		}
+		if d := got - tt.want; d < -time.Microsecond || d > time.Microsecond {
+			t.Errorf("%s: wait %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterNil(t *testing.T) {
+	var l *RateLimiter
+	l.Wait(1 << 30)
+}
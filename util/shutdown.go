@@ -0,0 +1,44 @@
+package util
+
+import (
+	"sync"
+)
+
+// Shutdown coordinates the teardown of a group of goroutines. Any of them
+// may call Begin, which is idempotent, and one goroutine waits for the
+// beginning, tears everything down and then calls Complete.
+type Shutdown struct {
+	sync.Mutex
+	inProgress bool
+	begin      chan int // closed when the shutdown begins
+	complete   chan int // closed when the shutdown completes
+}
+
+func NewShutdown() *Shutdown {
+	return &Shutdown{
+		begin:    make(chan int),
+		complete: make(chan int),
+	}
+}
+
+func (s *Shutdown) Begin() {
+	s.Lock()
+	defer s.Unlock()
+	if s.inProgress {
+		return
+	}
+	s.inProgress = true
+	close(s.begin)
+}
+
+func (s *Shutdown) WaitBegin() {
+	<-s.begin
+}
+
+func (s *Shutdown) Complete() {
+	close(s.complete)
+}
+
+func (s *Shutdown) WaitComplete() {
+	<-s.complete
+}
@@ -0,0 +1,20 @@
+package util
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// LoadCertPool reads a file of PEM encoded certificates into a pool.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math/rand"
@@ -17,6 +19,17 @@ func RandString(length int) string {
 	}
 	return a
 }
+
+// RandSecret returns n bytes from crypto/rand, hex encoded, for values that
+// mustn't be guessable.
+func RandSecret(n int) string {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 func PanicToError(fn func()) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -27,8 +40,34 @@ func PanicToError(fn func()) (err error) {
 	return
 }
 
-func PipeThenClose(src, dst net.Conn) {
+// PipeThenClose copies src to dst until src is done, then closes dst. It
+// returns the number of bytes copied and the error that ended the copy,
+// nil if src reached EOF. The copy doesn't outpace any of limits.
+func PipeThenClose(src, dst net.Conn, limits ...*RateLimiter) (written int64, err error) {
 	defer dst.Close()
-	io.Copy(dst, src)
-	return
+	if len(limits) == 0 {
+		written, err = io.Copy(dst, src)
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			for _, l := range limits {
+				l.Wait(n)
+			}
+			var m int
+			m, err = dst.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return
+		} else if rerr != nil {
+			err = rerr
+			return
+		}
+	}
 }